@@ -0,0 +1,200 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/30 10:30
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cyj19/sparrow/registry"
+	"sync"
+	"time"
+)
+
+var ErrBreakerOpen = errors.New("rpc client: the circuit breaker is open")
+
+// BreakerState 熔断器状态
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // 正常调用
+	BreakerOpen                         // 熔断，不再调用该服务
+	BreakerHalfOpen                     // 熔断超时后放行少量试探调用
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// BreakerConfig XClient为每个服务创建的熔断器的配置，字段为0时使用默认值
+type BreakerConfig struct {
+	Window           time.Duration // 统计错误率的时间窗口，默认10s
+	MinRequests      int           // 窗口内调用数达到该值才计算错误率，默认10
+	ErrorRate        float64       // 窗口内失败调用的比例达到该值时熔断，默认0.5
+	SlowCall         time.Duration // 耗时超过该值的调用视为失败，0表示不按耗时判断
+	OpenTimeout      time.Duration // 熔断后经过该时间进入半开状态，默认5s
+	HalfOpenRequests int           // 半开状态放行的试探调用数，全部成功后恢复，默认1
+	// OnStateChange 状态变化时调用，不能阻塞
+	OnStateChange func(server *registry.ServerItem, from, to BreakerState)
+}
+
+func (c *BreakerConfig) validate() error {
+	if c.Window < 0 || c.MinRequests < 0 || c.SlowCall < 0 || c.OpenTimeout < 0 || c.HalfOpenRequests < 0 {
+		return errors.New("rpc client: the breaker config must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return errors.New("rpc client: the breaker error rate must be in [0, 1]")
+	}
+	return nil
+}
+
+// withDefault 返回填充默认值后的配置
+func (c BreakerConfig) withDefault() *BreakerConfig {
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 10
+	}
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = 5 * time.Second
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = 1
+	}
+	return &c
+}
+
+// breaker 一个服务的熔断器
+type breaker struct {
+	config      *BreakerConfig
+	server      *registry.ServerItem
+	mu          *sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	total       int       // 窗口内的调用数
+	failures    int       // 窗口内失败的调用数
+	openedAt    time.Time // 熔断的时间
+	probes      int       // 半开状态已放行的调用数
+	successes   int       // 半开状态成功的调用数
+}
+
+func newBreaker(config *BreakerConfig, server *registry.ServerItem) *breaker {
+	return &breaker{
+		config:      config,
+		server:      server,
+		mu:          new(sync.Mutex),
+		windowStart: time.Now(),
+	}
+}
+
+// available 是否可以选择该服务，不占用半开状态的试探名额
+func (b *breaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.openedAt) >= b.config.OpenTimeout
+	case BreakerHalfOpen:
+		return b.probes < b.config.HalfOpenRequests
+	}
+	return true
+}
+
+// allow 是否放行一次调用，放行后必须调用done
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	from := b.state
+	allowed := true
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			allowed = false
+			break
+		}
+		b.state = BreakerHalfOpen
+		b.probes, b.successes = 1, 0
+	case BreakerHalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			allowed = false
+			break
+		}
+		b.probes++
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+	return allowed
+}
+
+// done 记录调用结果，服务端方法返回的错误和调用方取消的调用不算失败
+func (b *breaker) done(err error, latency time.Duration) {
+	var remoteErr *RemoteError
+	if errors.Is(err, context.Canceled) {
+		// 取消的试探调用没有结果，归还名额，否则可能一直停留在半开状态
+		b.mu.Lock()
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		b.mu.Unlock()
+		return
+	}
+	failed := (err != nil && !errors.As(err, &remoteErr)) ||
+		(b.config.SlowCall > 0 && latency > b.config.SlowCall)
+
+	b.mu.Lock()
+	from := b.state
+	now := time.Now()
+	switch b.state {
+	case BreakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart, b.total, b.failures = now, 0, 0
+		}
+		b.total++
+		if failed {
+			b.failures++
+		}
+		if b.total >= b.config.MinRequests && float64(b.failures) >= b.config.ErrorRate*float64(b.total) {
+			b.open(now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.open(now)
+			break
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.state = BreakerClosed
+			b.windowStart, b.total, b.failures = now, 0, 0
+		}
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+// open 熔断，调用方需持有b.mu
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+func (b *breaker) notify(from, to BreakerState) {
+	if from != to && b.config.OnStateChange != nil {
+		b.config.OnStateChange(b.server, from, to)
+	}
+}
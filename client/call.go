@@ -0,0 +1,61 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/28 9:30
+ */
+
+package client
+
+import "context"
+
+// Call 异步调用的结果，调用结束后被发送到Done
+type Call struct {
+	ServiceName   string
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	Error         error      // 调用结束后设置
+	Done          chan *Call // 带缓冲，调用结束时接收到Call本身
+}
+
+// goCall 在新的协程中执行invoke，返回对应的Call
+func goCall(serviceName, serviceMethod string, args, reply interface{}, invoke func(reply interface{}) error) *Call {
+	call := &Call{
+		ServiceName:   serviceName,
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+	}
+	go func() {
+		call.Error = invoke(reply)
+		call.Done <- call
+	}()
+	return call
+}
+
+// Go 异步调用，立即返回，通过返回值的Done等待调用结束
+func (c *Client) Go(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) *Call {
+	return goCall(serviceName, serviceMethod, args, reply, func(reply interface{}) error {
+		return c.Call(ctx, serviceName, serviceMethod, args, reply)
+	})
+}
+
+// Go 异步调用，立即返回，通过返回值的Done等待调用结束
+func (x *XClient) Go(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) *Call {
+	return goCall(serviceName, serviceMethod, args, reply, func(reply interface{}) error {
+		return x.Call(ctx, serviceName, serviceMethod, args, reply)
+	})
+}
+
+// Wait 等待所有调用结束，返回第一个失败的调用的错误
+// 每个Call的Done只能被接收一次，Wait之后不能再从Done接收
+func Wait(calls ...*Call) error {
+	var err error
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil && err == nil {
+			err = call.Error
+		}
+	}
+	return err
+}
@@ -9,221 +9,288 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/cyj19/sparrow/codec"
-	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/balance"
 	"github.com/cyj19/sparrow/discovery"
+	"github.com/cyj19/sparrow/metadata"
 	"github.com/cyj19/sparrow/protocol"
-	"github.com/cyj19/sparrow/transport"
+	"github.com/cyj19/sparrow/registry"
 	"github.com/rs/xid"
-	"log"
-	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Caller struct {
-	Reply interface{} // 调用结果
-	done  chan error  // 通知调用结束
+	Reply   interface{} // 调用结果
+	method  string      // 调用的服务方法，用于记录服务端分配的方法编号
+	done    chan error  // 通知调用结束
+	trailer metadata.MD // 响应携带的元数据，由respMutex保护
 }
 
+var (
+	ErrClientClosed = errors.New("rpc client: client is closed")
+	ErrReconnecting = errors.New("rpc client: the connection is broken, reconnecting")
+)
+
 type Client struct {
 	Option    *Option
-	discovery discovery.Discovery
-	reqMutex  *sync.Mutex
-	respMutex *sync.Mutex
-	conn      net.Conn
-	callMap   map[string]*Caller
-	close     chan error // 通知关闭连接
+	discovery discovery.Discovery // 重连时重新选择服务，为nil时只重连原来的服务
+	mu        *sync.Mutex         // 保护cn、ready和closed
+	cn        *connection         // 当前使用的连接
+	ready     chan struct{}       // 重连期间不为nil，重连结束时关闭
+	closed    bool
+	stop      chan struct{} // 关闭客户端时停止重连
+	pending   int64         // 进行中的调用数，原子更新
+	lastUsed  int64         // 最近一次调用的时间，UnixNano，原子更新
+	created   time.Time     // 创建客户端的时间
 }
 
-func NewClient(d discovery.Discovery) (*Client, error) {
-	c := &Client{
-		Option:    defaultOption(),
-		discovery: d,
-		reqMutex:  new(sync.Mutex),
-		respMutex: new(sync.Mutex),
-		callMap:   map[string]*Caller{},
-		close:     make(chan error),
+func NewClient(d discovery.Discovery, fns ...OptionSetter) (*Client, error) {
+	option := defaultOption()
+	for _, fn := range fns {
+		fn(option)
+	}
+	if err := option.validate(); err != nil {
+		return nil, err
 	}
-	serverItem, err := d.Get()
+	serverItem, err := selectServer(d, option.loadBalance)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := transport.Client.Gen(transport.Protocol(serverItem.Protocol), serverItem.Addr, c.Option.connectTimeout)
+	return dial(d, serverItem, option)
+}
+
+// dial 连接指定的服务并完成握手
+// d为nil时重连固定使用该服务，连接池中的连接属于该服务的连接池和熔断器，不能换到其他服务
+func dial(d discovery.Discovery, serverItem *registry.ServerItem, option *Option) (*Client, error) {
+	c := &Client{
+		Option:    option,
+		discovery: d,
+		mu:        new(sync.Mutex),
+		stop:      make(chan struct{}),
+		created:   time.Now(),
+	}
+	cn, err := newConnection(serverItem, option, c.onBroken)
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn
-	go c.receive()
+	c.cn = cn
 	return c, nil
 }
 
-func (c *Client) registerCall(magic string, caller *Caller) {
-	c.respMutex.Lock()
-	c.callMap[magic] = caller
-	c.respMutex.Unlock()
+// Close 关闭连接，不再重连
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	// 唤醒等待重连的调用
+	if c.ready != nil {
+		close(c.ready)
+		c.ready = nil
+	}
+	return c.cn.close()
 }
 
-func (c *Client) removeCall(magic string) {
-	c.respMutex.Lock()
-	delete(c.callMap, magic)
-	c.respMutex.Unlock()
+// Closed 客户端是否已经不可用，开启重连时只有调用Close后才不可用
+func (c *Client) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	return c.cn.broken() && c.ready == nil && !c.Option.reconnect
 }
 
-func (c *Client) Call(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error {
+// connection 获取当前的连接，正在重连时根据配置立即失败或等待重连结束
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	for {
+		c.mu.Lock()
+		closed, cn, ready := c.closed, c.cn, c.ready
+		c.mu.Unlock()
+		if closed {
+			return nil, ErrClientClosed
+		}
+		if ready == nil {
+			return cn, nil
+		}
+		if !c.Option.reconnectQueue {
+			return nil, ErrReconnecting
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		}
+	}
+}
 
-	if serviceName == "" || serviceMethod == "" {
-		return errors.New("serviceName or serviceMethod is null")
+// selectServer 选择连接的服务，lb不为nil时从所有服务中选择，否则使用服务发现自身的负载均衡
+func selectServer(d discovery.Discovery, lb balance.LoadBalancing) (*registry.ServerItem, error) {
+	if lb == nil {
+		return d.Get()
+	}
+	servers, err := d.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("rpc client: no available servers")
 	}
+	return servers[lb.GetModeResult(len(servers))], nil
+}
 
-	done := make(chan error, 0)
-	// 生成魔法值
-	magic := xid.New().String()
-	defer func() {
-		c.removeCall(magic)
-	}()
+// acquire 记录一个进行中的调用，连接池据此选择最空闲的连接
+func (c *Client) acquire() {
+	atomic.AddInt64(&c.pending, 1)
+	c.touch()
+}
 
-	go c.call(done, magic, serviceName, serviceMethod, args, reply)
+func (c *Client) release() {
+	c.touch()
+	atomic.AddInt64(&c.pending, -1)
+}
 
-	select {
-	case <-ctx.Done():
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
-	case err, ok := <-done:
-		if !ok {
-			return nil
-		}
-		return err
-	case err := <-c.close:
-		return errors.New("connect closed by error: " + err.Error())
-	}
+// touch 更新最近一次使用的时间
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+}
 
+// busy 进行中的调用数
+func (c *Client) busy() int64 {
+	return atomic.LoadInt64(&c.pending)
 }
 
-func (c *Client) call(done chan error, magic, serviceName, serviceMethod string, args, reply interface{}) {
-	// 构建请求
-	reqHeader := &protocol.Header{
-		Start:          protocol.StartChar,
-		Version:        byte(1),
-		CodecType:      byte(c.Option.codecType),
-		CompressorType: byte(c.Option.compressorType),
+// idle 连接已经空闲的时间，有进行中的调用时为0
+func (c *Client) idle() time.Duration {
+	if c.busy() > 0 {
+		return 0
 	}
-
-	reqBody := &protocol.Body{
-		Magic:         magic,
-		ServiceName:   serviceName,
-		ServiceMethod: serviceMethod,
+	lastUsed := atomic.LoadInt64(&c.lastUsed)
+	if lastUsed == 0 {
+		return time.Since(c.created)
 	}
+	return time.Since(time.Unix(0, lastUsed))
+}
 
-	// 序列化
-	codecPlugin, ok := codec.Get(c.Option.codecType)
-	if !ok {
-		c.close <- errors.New("codec plugin is not exist")
+func (c *Client) Call(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error {
+	c.acquire()
+	defer c.release()
+
+	if serviceName == "" || serviceMethod == "" {
+		return errors.New("serviceName or serviceMethod is null")
 	}
-	payload, err := codecPlugin.Encode(args)
-	if err != nil {
-		c.close <- errors.New(fmt.Sprintf("client encode payload error:%v", err))
+	if len(c.Option.interceptors) == 0 {
+		return c.invoke(ctx, serviceName, serviceMethod, args, reply)
 	}
-	// 压缩
-	cpr, ex := compressor.Get(c.Option.compressorType)
-	if !ex {
-		c.close <- errors.New("compress plugin is not exist")
+	return chainInterceptors(c.Option.interceptors, c.invoke)(ctx, serviceName, serviceMethod, args, reply)
+}
+
+// invoke 发送请求并等待响应，拦截器最终调用它
+func (c *Client) invoke(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error {
+	cn, err := c.connection(ctx)
+	if err != nil {
+		return err
 	}
-	payload, err = cpr.Zip(payload)
+	// 生成序列号
+	seq := cn.nextSeq()
+	reqMsg, err := cn.newRequest(protocol.Request, seq, c.outgoingMetadata(ctx), serviceName, serviceMethod, args)
 	if err != nil {
-		c.close <- errors.New(fmt.Sprintf("client compress payload error:%#v", err))
+		return err
 	}
-	reqBody.Payload = payload
-	reqMsg := &protocol.Message{
-		Header: reqHeader,
-		Body:   reqBody,
+	// 带缓冲，调用方超时返回后发送结果也不会阻塞
+	done := make(chan error, 1)
+	caller := &Caller{
+		Reply:  reply,
+		method: serviceName + "." + serviceMethod,
+		done:   done,
 	}
-
-	reqData, err := protocol.EncodeMessage(reqMsg)
-	if err != nil {
-		c.close <- errors.New(fmt.Sprintf("client encode message error:%v", err))
+	// 在当前协程中登记并写入请求，保证取消消息在请求之后发送
+	if err = cn.send(ctx, reqMsg, caller); err != nil {
+		return err
 	}
+	defer func() {
+		cn.removeCall(seq)
+	}()
 
-	// 设置写超时
-	if c.Option.writeTimeout > 0 {
-		now := time.Now()
-		_ = c.conn.SetWriteDeadline(now.Add(c.Option.writeTimeout))
+	err = cn.wait(ctx, done)
+	// 在调用方的协程中写入接收响应元数据的容器，调用方可能在等待结束后立即读取它
+	if trailer, ok := metadata.FromTrailerContext(ctx); ok {
+		for k, v := range cn.trailer(caller) {
+			trailer[k] = v
+		}
 	}
-
-	c.reqMutex.Lock()
-	_, err = c.conn.Write(reqData)
-	c.reqMutex.Unlock()
-
-	if err != nil {
-		c.close <- err
+	// 调用被放弃，通知服务端取消处理
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		go cn.cancel(seq)
 	}
+	return err
+}
 
-	c.registerCall(magic, &Caller{
-		Reply: reply,
-		done:  done,
-	})
-
+// outgoingMetadata 请求携带的元数据
+func (c *Client) outgoingMetadata(ctx context.Context) metadata.MD {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if c.Option.magic {
+		md = metadata.Join(md, metadata.Pairs(metadata.MagicKey, xid.New().String()))
+	}
+	// 传递剩余的超时时间，服务端据此设置方法的ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		md = metadata.Join(md, metadata.Pairs(metadata.TimeoutKey, time.Until(deadline).String()))
+	}
+	return md
 }
 
-func (c *Client) receive() {
-	defer func() {
-		_ = c.conn.Close()
-	}()
-	for {
-		callDone, err := c.handleResponse()
-		// 调用出错
-		if err != nil && callDone != nil {
-			callDone <- err
-		}
-		// 客户端发生错误
-		if err != nil && callDone == nil {
-			c.close <- err
-			break
-		}
-		// 正常调用结束
-		if err == nil && callDone != nil {
-			close(callDone)
-		}
+// Notify 单向调用，请求写入连接后立即返回，服务端执行方法但不回复，方法的错误也不会返回
+// 配置的拦截器同样会执行，此时reply为nil
+func (c *Client) Notify(ctx context.Context, serviceName, serviceMethod string, args interface{}) error {
+	c.acquire()
+	defer c.release()
 
+	if serviceName == "" || serviceMethod == "" {
+		return errors.New("serviceName or serviceMethod is null")
 	}
+	if len(c.Option.interceptors) == 0 {
+		return c.notify(ctx, serviceName, serviceMethod, args, nil)
+	}
+	return chainInterceptors(c.Option.interceptors, c.notify)(ctx, serviceName, serviceMethod, args, nil)
 }
 
-func (c *Client) handleResponse() (done chan error, err error) {
-	// 设置读超时
-	if c.Option.readTimeout > 0 {
-		now := time.Now()
-		_ = c.conn.SetReadDeadline(now.Add(c.Option.readTimeout))
-	}
-	msg, err := protocol.DecodeMessage(c.conn)
+func (c *Client) notify(ctx context.Context, serviceName, serviceMethod string, args, _ interface{}) error {
+	cn, err := c.connection(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	caller, ex := c.callMap[msg.Body.Magic]
-	if !ex {
-		err = errors.New("codec plugin is not exist")
-		return nil, err
+	if err = ctx.Err(); err != nil {
+		return fmt.Errorf("rpc client: call failed: %w", err)
 	}
-	// 解压
-	compressorType := compressor.CompressorType(msg.Header.CompressorType)
-	compressPlugin, ex := compressor.Get(compressorType)
-	if !ex {
-		err = errors.New("compressor plugin is not exist")
-		return nil, err
+	reqMsg, err := cn.newRequest(protocol.Oneway, cn.nextSeq(), c.outgoingMetadata(ctx), serviceName, serviceMethod, args)
+	if err != nil {
+		return err
 	}
-	msg.Body.Payload, err = compressPlugin.Unzip(msg.Body.Payload)
+	return cn.sendOneway(reqMsg)
+}
+
+// Ping 发送心跳，检测连接和服务端是否可用
+func (c *Client) Ping(ctx context.Context) error {
+	cn, err := c.connection(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// 反序列化
-	cType := codec.CodecType(msg.Header.CodecType)
-	codecPlugin, ok := codec.Get(cType)
-	if !ok {
-		err = errors.New("codec plugin is not exist")
-		return nil, err
+	done := make(chan error, 1)
+	seq := cn.nextSeq()
+	defer func() {
+		cn.removeCall(seq)
+	}()
+
+	reqMsg := &protocol.Message{
+		Header: cn.newHeader(protocol.Heartbeat, seq),
+		Body:   &protocol.Body{},
 	}
-	err = codecPlugin.Decode(msg.Body.Payload, caller.Reply)
-	if err != nil {
-		log.Printf("client decode error:%#v", err)
-		return caller.done, err
+	if err = cn.send(ctx, reqMsg, &Caller{done: done}); err != nil {
+		return err
 	}
-	return caller.done, nil
+	return cn.wait(ctx, done)
 }
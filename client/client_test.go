@@ -0,0 +1,755 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/15 11:02
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/cyj19/sparrow/balance"
+	"github.com/cyj19/sparrow/discovery"
+	"github.com/cyj19/sparrow/metadata"
+	"github.com/cyj19/sparrow/protocol"
+	"github.com/cyj19/sparrow/registry"
+	"github.com/cyj19/sparrow/server"
+	"github.com/cyj19/sparrow/transport"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Arith struct {
+}
+
+type ArithArgs struct {
+	A, B int
+}
+
+type ArithReply struct {
+	C int
+}
+
+func (a *Arith) Add(args *ArithArgs, reply *ArithReply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (a *Arith) Div(args *ArithArgs, reply *ArithReply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+// Tenant 读取请求的元数据并通过响应元数据带回
+func (a *Arith) Tenant(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return errors.New("metadata is not exist")
+	}
+	reply.C = args.A + args.B
+	return metadata.SetTrailer(ctx, metadata.Pairs("tenant", md.Get("tenant")))
+}
+
+// Deadline 返回方法ctx剩余的超时时间，单位毫秒
+func (a *Arith) Deadline(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("deadline is not exist")
+	}
+	reply.C = int(time.Until(deadline) / time.Millisecond)
+	return nil
+}
+
+// blocked Block方法结束的原因
+var blocked = make(chan error, 1)
+
+// Block 阻塞直到ctx结束
+func (a *Arith) Block(ctx context.Context, args *ArithArgs, reply *ArithReply) error {
+	<-ctx.Done()
+	blocked <- ctx.Err()
+	return ctx.Err()
+}
+
+// notified Notify方法收到的参数
+var notified = make(chan *ArithArgs, 1)
+
+// Notify 单向调用的方法，返回的错误不会回复给客户端
+func (a *Arith) Notify(args *ArithArgs, reply *ArithReply) error {
+	notified <- args
+	return errors.New("ignored")
+}
+
+// startServer 在临时unix socket上启动服务端
+func startServer(t *testing.T, fns ...server.OptionSetter) *registry.ServerItem {
+	addr := filepath.Join(t.TempDir(), "sparrow.sock")
+	s := server.NewServer()
+	if err := s.Register(&Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Run(append(fns, server.UseUnix(addr))...)
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return &registry.ServerItem{Protocol: string(transport.UNIX), Addr: addr}
+}
+
+func newTestClient(t *testing.T, fns ...server.OptionSetter) *Client {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t, fns...))
+	c, err := NewClient(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient_Call(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply := &ArithReply{}
+	err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 {
+		t.Fatalf("expect 3, got %d", reply.C)
+	}
+}
+
+func TestClient_CallRemoteError(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cases := []struct {
+		service, method string
+		args            *ArithArgs
+	}{
+		{"Arith", "Div", &ArithArgs{A: 1, B: 0}},
+		{"Arith", "Mul", &ArithArgs{A: 1, B: 2}},
+		{"Calc", "Add", &ArithArgs{A: 1, B: 2}},
+	}
+	for _, cs := range cases {
+		err := c.Call(ctx, cs.service, cs.method, cs.args, &ArithReply{})
+		var remoteErr *RemoteError
+		if !errors.As(err, &remoteErr) {
+			t.Fatalf("%s.%s: expect RemoteError, got %v", cs.service, cs.method, err)
+		}
+		t.Log(remoteErr)
+	}
+}
+
+func TestClient_CallMetadata(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("tenant", "sparrow"))
+	ctx, trailer := metadata.NewTrailerContext(ctx)
+	err := c.Call(ctx, "Arith", "Tenant", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trailer.Get("tenant") != "sparrow" {
+		t.Fatalf("expect trailer tenant=sparrow, got %v", trailer)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_CallFrameTooLarge(t *testing.T) {
+	c := newTestClient(t, server.UseLimit(&protocol.Limit{MaxBodySize: 256}))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("token", strings.Repeat("x", 512)))
+	err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	var sizeErr *protocol.FrameSizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("expect FrameSizeError, got %v", err)
+	}
+}
+
+func TestClient_CallResponseTooLarge(t *testing.T) {
+	// 响应携带的元数据超过客户端的限制
+	large := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		if err := metadata.SetTrailer(ctx, metadata.Pairs("large", strings.Repeat("x", 1024))); err != nil {
+			return err
+		}
+		return handler(ctx, args, reply)
+	}
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t, server.UseInterceptor(large)))
+	c, err := NewClient(d, WithLimit(&protocol.Limit{MaxBodySize: 512}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 服务端按协商的最大消息体大小回复错误，连接仍然可用
+	err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Message, "exceeds the limit 512") {
+		t.Fatalf("expect remote FrameSizeError, got %v", err)
+	}
+	if err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_CallResponseFieldTooLarge(t *testing.T) {
+	// 错误信息和响应元数据超过客户端默认的64KiB限制
+	large := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		switch info.ServiceMethod {
+		case "Div":
+			return errors.New(strings.Repeat("x", 128<<10))
+		case "Tenant":
+			if err := metadata.SetTrailer(ctx, metadata.Pairs("large", strings.Repeat("x", 128<<10))); err != nil {
+				return err
+			}
+		}
+		return handler(ctx, args, reply)
+	}
+	c := newTestClient(t, server.UseInterceptor(large))
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 服务端按协商的限制替换为错误回复，连接仍然可用
+	var remoteErr *RemoteError
+	err := c.Call(ctx, "Arith", "Div", &ArithArgs{A: 4, B: 2}, &ArithReply{})
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Message, "error size") {
+		t.Fatalf("expect remote error size error, got %v", err)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("tenant", "inner"))
+	err = c.Call(ctx, "Arith", "Tenant", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Message, "metadata size") {
+		t.Fatalf("expect remote metadata size error, got %v", err)
+	}
+	if err = c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startFakeServer 在临时unix socket上启动只回复握手消息的服务端，用于模拟异常的服务端
+func startFakeServer(t *testing.T) *registry.ServerItem {
+	addr := filepath.Join(t.TempDir(), "fake.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					msg, err := protocol.DecodeMessage(conn)
+					if err != nil {
+						return
+					}
+					payload, _ := protocol.EncodeHandshake(&protocol.HandshakeInfo{
+						Version:     protocol.Version,
+						Codecs:      []byte{msg.Header.CodecType},
+						Compressors: []byte{msg.Header.CompressorType},
+					})
+					header := *msg.Header
+					header.MessageType = byte(protocol.Handshake)
+					header.Flags = 0
+					header.Extensions = nil
+					data, _ := protocol.EncodeMessage(&protocol.Message{Header: &header, Body: &protocol.Body{Payload: payload}})
+					if _, err = conn.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return &registry.ServerItem{Protocol: string(transport.UNIX), Addr: addr}
+}
+
+func TestClient_UnexpectedHandshake(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startFakeServer(t))
+	c, err := NewClient(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 普通调用和心跳收到握手回复时只有该调用失败
+	if err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{}); err == nil || !strings.Contains(err.Error(), "unexpected handshake") {
+		t.Fatalf("expect unexpected handshake error, got %v", err)
+	}
+	if err = c.Ping(ctx); err == nil || !strings.Contains(err.Error(), "unexpected handshake") {
+		t.Fatalf("expect unexpected handshake error, got %v", err)
+	}
+	if c.Closed() {
+		t.Fatal("expect the connection alive")
+	}
+}
+
+func TestClient_CallChecksum(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t))
+	c, err := NewClient(d, WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply := &ArithReply{}
+	err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 {
+		t.Fatalf("expect 3, got %d", reply.C)
+	}
+}
+
+func TestClient_CallMethodID(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		reply := &ArithReply{}
+		err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: i, B: 2}, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.C != i+2 {
+			t.Fatalf("expect %d, got %d", i+2, reply.C)
+		}
+		// 第一次调用后得知方法编号
+		if _, ok := c.cn.methodID("Arith.Add"); !ok {
+			t.Fatal("expect method id of Arith.Add")
+		}
+	}
+}
+
+func TestClient_CallDeadline(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply := &ArithReply{}
+	err := c.Call(ctx, "Arith", "Deadline", &ArithArgs{}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.C <= 0 || reply.C > 5000 {
+		t.Fatalf("expect remaining timeout in (0, 5000]ms, got %d", reply.C)
+	}
+}
+
+func TestClient_CallCancel(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := c.Call(ctx, "Arith", "Block", &ArithArgs{}, &ArithReply{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+	// 服务端的方法随之取消
+	select {
+	case err = <-blocked:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expect server context canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server method is not canceled")
+	}
+}
+
+func TestClient_CallFragment(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t, server.UseFragmentSize(16)))
+	c, err := NewClient(d, WithFragmentSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cn.fragmentSize != 8 {
+		t.Fatalf("expect fragment size 8, got %d", c.cn.fragmentSize)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("tenant", "sparrow"))
+	ctx, trailer := metadata.NewTrailerContext(ctx)
+	reply := &ArithReply{}
+	err = c.Call(ctx, "Arith", "Tenant", &ArithArgs{A: 1, B: 2}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 || trailer.Get("tenant") != "sparrow" {
+		t.Fatalf("expect 3 and tenant=sparrow, got %d and %v", reply.C, trailer)
+	}
+}
+
+func TestNewClient_InvalidOption(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t))
+	cases := map[string]OptionSetter{
+		"codec":      WithCodec(100),
+		"compressor": WithCompressor(100),
+		"timeout":    WithReadTimeout(-time.Second),
+		"handshake":  WithHandshakeTimeout(0),
+	}
+	for name, fn := range cases {
+		if _, err := NewClient(d, fn); err == nil {
+			t.Fatalf("%s: expect error", name)
+		}
+	}
+}
+
+// lastBalance 总是选择最后一个服务
+type lastBalance struct{}
+
+func (lastBalance) GetModeResult(n int) int {
+	return n - 1
+}
+
+func TestClient_WithLoadBalance(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	// 第一个服务不存在，只有使用配置的负载均衡插件才能连接成功
+	d.Register(&registry.ServerItem{Protocol: string(transport.UNIX), Addr: filepath.Join(t.TempDir(), "none.sock")})
+	d.Register(startServer(t))
+	c, err := NewClient(d, WithLoadBalance(lastBalance{}), WithConnectTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply := &ArithReply{}
+	err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 {
+		t.Fatalf("expect 3, got %d", reply.C)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t))
+	c, err := NewClient(d, WithReconnect(10*time.Millisecond, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 连接断开时等待响应的调用立即失败
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Call(ctx, "Arith", "Block", &ArithArgs{}, &ArithReply{})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	old := c.cn
+	_ = old.close()
+	select {
+	case err = <-errCh:
+		if err == nil || errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect connection error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending call is not failed")
+	}
+	<-blocked
+
+	// 重连成功后调用恢复正常
+	for {
+		reply := &ArithReply{}
+		err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrReconnecting) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mu.Lock()
+	cn := c.cn
+	c.mu.Unlock()
+	if cn == old || c.Closed() {
+		t.Fatal("expect a new connection")
+	}
+}
+
+func TestClient_ReconnectQueue(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t))
+	c, err := NewClient(d, WithReconnect(10*time.Millisecond, 100*time.Millisecond), WithReconnectQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_ = c.cn.close()
+	time.Sleep(10 * time.Millisecond)
+	// 重连期间的调用等待重连结束
+	reply := &ArithReply{}
+	if err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 3 {
+		t.Fatalf("expect 3, got %d", reply.C)
+	}
+
+	_ = c.Close()
+	if err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != ErrClientClosed {
+		t.Fatalf("expect ErrClientClosed, got %v", err)
+	}
+}
+
+func TestClient_BrokenFanOut(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const n = 5
+	errCh := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errCh <- c.Call(ctx, "Arith", "Block", &ArithArgs{}, &ArithReply{})
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	_ = c.cn.close()
+	// 每个等待响应的调用都立即收到连接断开的错误
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errCh:
+			if err == nil || errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expect connection error, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d pending calls are failed", i, n)
+		}
+		<-blocked
+	}
+	if !c.Closed() {
+		t.Fatal("expect client closed")
+	}
+}
+
+func TestClient_Go(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := make([]*Call, 0, 10)
+	for i := 0; i < 10; i++ {
+		calls = append(calls, c.Go(ctx, "Arith", "Add", &ArithArgs{A: i, B: i}, &ArithReply{}))
+	}
+	if err := Wait(calls...); err != nil {
+		t.Fatal(err)
+	}
+	for i, call := range calls {
+		if reply := call.Reply.(*ArithReply); reply.C != 2*i {
+			t.Fatalf("expect %d, got %d", 2*i, reply.C)
+		}
+	}
+
+	call := <-c.Go(ctx, "Arith", "Div", &ArithArgs{A: 1, B: 0}, &ArithReply{}).Done
+	if call.Error == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestClient_Interceptor(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	d.Register(startServer(t))
+	var order []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+			order = append(order, name)
+			ctx = metadata.AppendToOutgoingContext(ctx, "tenant", name)
+			return invoker(ctx, serviceName, serviceMethod, args, reply)
+		}
+	}
+	errInjected := errors.New("injected")
+	fault := func(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		if serviceMethod == "Div" {
+			return errInjected
+		}
+		return invoker(ctx, serviceName, serviceMethod, args, reply)
+	}
+	c, err := NewClient(d, WithInterceptor(record("outer"), record("inner")), WithInterceptor(fault))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 内层拦截器添加的元数据覆盖外层的
+	ctx, trailer := metadata.NewTrailerContext(ctx)
+	reply := &ArithReply{}
+	if err = c.Call(ctx, "Arith", "Tenant", &ArithArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Fatalf("expect outer then inner, got %v", order)
+	}
+	if trailer.Get("tenant") != "inner" {
+		t.Fatalf("expect tenant inner, got %v", trailer)
+	}
+
+	if err = c.Call(ctx, "Arith", "Div", &ArithArgs{A: 1, B: 1}, reply); err != errInjected {
+		t.Fatalf("expect injected error, got %v", err)
+	}
+}
+
+// TestServer_Interceptor 服务端拦截器需要客户端发起调用，server包没有测试辅助，放在这里与其他调用测试共用startServer
+func TestServer_Interceptor(t *testing.T) {
+	infos := make(chan *server.RequestInfo, 2)
+	record := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		infos <- info
+		return handler(ctx, args, reply)
+	}
+	auth := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		if info.Metadata.Get("token") != "secret" {
+			return errors.New("unauthenticated")
+		}
+		return handler(ctx, args, reply)
+	}
+	// 替换传给方法的参数
+	double := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		a := args.(*ArithArgs)
+		return handler(ctx, &ArithArgs{A: a.A * 2, B: a.B * 2}, reply)
+	}
+	c := newTestClient(t, server.UseInterceptor(record, auth, double))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 拦截器直接返回错误，不调用方法
+	err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "unauthenticated" {
+		t.Fatalf("expect unauthenticated, got %v", err)
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("token", "secret"))
+	reply := &ArithReply{}
+	if err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.C != 6 {
+		t.Fatalf("expect 6, got %d", reply.C)
+	}
+	<-infos
+	info := <-infos
+	if info.ServiceName != "Arith" || info.ServiceMethod != "Add" || info.RemoteAddr == nil {
+		t.Fatalf("unexpected request info %+v", info)
+	}
+	// 替换参数不影响请求信息中反序列化后的参数
+	if args, ok := info.Args.(*ArithArgs); !ok || args.A != 1 || args.B != 2 {
+		t.Fatalf("expect decoded args, got %#v", info.Args)
+	}
+}
+
+func TestServer_InterceptorReplace(t *testing.T) {
+	replace := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		switch info.ServiceMethod {
+		case "Add":
+			// 回复方法实际收到的reply
+			return handler(ctx, args, &ArithReply{})
+		case "Div":
+			return handler(ctx, &struct{ X int }{}, reply)
+		case "Tenant":
+			panic("broken interceptor")
+		}
+		return handler(ctx, args, reply)
+	}
+	c := newTestClient(t, server.UseInterceptor(replace))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply := &ArithReply{}
+	if err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil || reply.C != 3 {
+		t.Fatalf("expect 3, got %d %v", reply.C, err)
+	}
+	// 参数类型不一致和panic都回复错误，服务端继续运行
+	var remoteErr *RemoteError
+	err := c.Call(ctx, "Arith", "Div", &ArithArgs{A: 4, B: 2}, &ArithReply{})
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Message, "args type") {
+		t.Fatalf("expect args type error, got %v", err)
+	}
+	err = c.Call(ctx, "Arith", "Tenant", &ArithArgs{A: 1, B: 2}, &ArithReply{})
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Message, "panic") {
+		t.Fatalf("expect panic error, got %v", err)
+	}
+	if err = c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_Notify(t *testing.T) {
+	c := newTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Notify(ctx, "Arith", "Notify", &ArithArgs{A: 1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case args := <-notified:
+		if args.A != 1 || args.B != 2 {
+			t.Fatalf("unexpected args %+v", args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the method is not called")
+	}
+	// 单向调用不登记，服务端也不回复，连接可以继续使用
+	c.cn.respMutex.Lock()
+	n := len(c.cn.callMap)
+	c.cn.respMutex.Unlock()
+	if n != 0 {
+		t.Fatalf("expect no pending call, got %d", n)
+	}
+	reply := &ArithReply{}
+	if err := c.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil || reply.C != 3 {
+		t.Fatalf("expect 3, got %d %v", reply.C, err)
+	}
+}
@@ -0,0 +1,469 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/26 9:30
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cyj19/sparrow/codec"
+	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/metadata"
+	"github.com/cyj19/sparrow/protocol"
+	"github.com/cyj19/sparrow/registry"
+	"github.com/cyj19/sparrow/transport"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connection 与服务端的一个连接，序列号、方法编号和协商结果都只在该连接上有效
+// 连接断开后不再使用，重连时由新的connection替换
+type connection struct {
+	option         *Option
+	server         *registry.ServerItem
+	conn           net.Conn
+	reqMutex       *sync.Mutex
+	respMutex      *sync.Mutex
+	encoder        *protocol.Encoder
+	decoder        *protocol.Decoder
+	assembler      *protocol.Assembler // 重组响应的分片，只在接收协程中使用
+	seq            uint64              // 最近一次调用的序列号，原子递增
+	callMap        map[uint64]*Caller
+	idMutex        *sync.Mutex
+	methodIDs      map[string]uint32         // 服务端分配的方法编号，key为serviceName.serviceMethod
+	shutdown       chan struct{}             // 连接断开时关闭
+	err            error                     // 连接断开的原因，shutdown关闭后只读
+	failed         bool                      // 连接已经断开，不再登记调用，由respMutex保护
+	version        byte                      // 协商后的协议版本
+	codecType      codec.CodecType           // 协商后的序列化类型
+	compressorType compressor.CompressorType // 协商后的压缩类型
+	maxFrameSize   uint32                    // 协商后的最大消息体大小
+	fragmentSize   uint32                    // 协商后的分片大小，0表示不分片
+}
+
+// newConnection 连接指定的服务并完成握手，连接断开时调用onBroken
+func newConnection(server *registry.ServerItem, option *Option, onBroken func(cn *connection)) (*connection, error) {
+	conn, err := transport.Client.Gen(transport.Protocol(server.Protocol), server.Addr, option.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &connection{
+		option:         option,
+		server:         server,
+		conn:           conn,
+		reqMutex:       new(sync.Mutex),
+		respMutex:      new(sync.Mutex),
+		encoder:        protocol.NewEncoder(conn),
+		decoder:        protocol.NewDecoder(conn, option.limit),
+		assembler:      protocol.NewAssembler(option.limit),
+		callMap:        map[uint64]*Caller{},
+		idMutex:        new(sync.Mutex),
+		methodIDs:      map[string]uint32{},
+		shutdown:       make(chan struct{}),
+		version:        protocol.Version,
+		codecType:      option.codecType,
+		compressorType: option.compressorType,
+	}
+	go cn.receive(onBroken)
+	if err = cn.handshake(); err != nil {
+		_ = cn.close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (cn *connection) close() error {
+	return cn.conn.Close()
+}
+
+// broken 连接是否已经断开
+func (cn *connection) broken() bool {
+	select {
+	case <-cn.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail 记录连接断开的原因，立即通知所有等待响应的调用
+// 之后登记的调用直接失败，每个调用只会收到一次结果
+func (cn *connection) fail(err error) {
+	cn.respMutex.Lock()
+	cn.failed = true
+	callMap := cn.callMap
+	cn.callMap = map[uint64]*Caller{}
+	cn.respMutex.Unlock()
+
+	err = fmt.Errorf("connect closed by error: %w", err)
+	cn.err = err
+	close(cn.shutdown)
+	for _, caller := range callMap {
+		caller.done <- err
+	}
+}
+
+// nextSeq 生成调用的序列号，从1开始，0表示不属于任何调用
+func (cn *connection) nextSeq() uint64 {
+	return atomic.AddUint64(&cn.seq, 1)
+}
+
+// methodID 获取服务端分配的方法编号
+func (cn *connection) methodID(method string) (uint32, bool) {
+	cn.idMutex.Lock()
+	defer cn.idMutex.Unlock()
+	id, ok := cn.methodIDs[method]
+	return id, ok
+}
+
+func (cn *connection) setMethodID(method string, id uint32) {
+	cn.idMutex.Lock()
+	cn.methodIDs[method] = id
+	cn.idMutex.Unlock()
+}
+
+// registerCall 登记等待响应的调用，连接已经断开时返回错误
+func (cn *connection) registerCall(seq uint64, caller *Caller) error {
+	cn.respMutex.Lock()
+	defer cn.respMutex.Unlock()
+	if cn.failed {
+		return errors.New("rpc client: the connection is broken")
+	}
+	cn.callMap[seq] = caller
+	return nil
+}
+
+// takeCall 取出等待响应的调用，取出后由调用方负责通知它
+func (cn *connection) takeCall(seq uint64) (*Caller, bool) {
+	cn.respMutex.Lock()
+	defer cn.respMutex.Unlock()
+	caller, ok := cn.callMap[seq]
+	if ok {
+		delete(cn.callMap, seq)
+	}
+	return caller, ok
+}
+
+func (cn *connection) removeCall(seq uint64) {
+	cn.respMutex.Lock()
+	delete(cn.callMap, seq)
+	cn.respMutex.Unlock()
+}
+
+// setTrailer 记录响应携带的元数据，调用方可能已经结束等待，需要加锁
+func (cn *connection) setTrailer(caller *Caller, md metadata.MD) {
+	cn.respMutex.Lock()
+	caller.trailer = md
+	cn.respMutex.Unlock()
+}
+
+// trailer 获取响应携带的元数据，还没有收到响应时返回nil
+func (cn *connection) trailer(caller *Caller) metadata.MD {
+	cn.respMutex.Lock()
+	defer cn.respMutex.Unlock()
+	return caller.trailer
+}
+
+// wait 等待调用结束
+func (cn *connection) wait(ctx context.Context, done chan error) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+	case err, ok := <-done:
+		if !ok {
+			return nil
+		}
+		return err
+	case <-cn.shutdown:
+		return cn.err
+	}
+
+}
+
+// cancel 发送取消消息，服务端会取消方法的ctx并丢弃响应
+func (cn *connection) cancel(seq uint64) {
+	msg := &protocol.Message{
+		Header: cn.newHeader(protocol.Cancel, seq),
+		Body:   &protocol.Body{},
+	}
+	if err := cn.write(msg); err != nil {
+		log.Printf("rpc client: send cancel of seq:%d error:%v", seq, err)
+	}
+}
+
+// newRequest 构建请求，序列化并压缩参数
+func (cn *connection) newRequest(msgType protocol.MessageType, seq uint64, md metadata.MD, serviceName, serviceMethod string, args interface{}) (*protocol.Message, error) {
+	reqHeader := cn.newHeader(msgType, seq)
+	reqBody := &protocol.Body{
+		Metadata: md,
+	}
+	// 已知方法编号时只发送编号，否则发送名称
+	if id, ok := cn.methodID(serviceName + "." + serviceMethod); ok {
+		reqHeader.MethodID = id
+	} else {
+		reqBody.ServiceName = serviceName
+		reqBody.ServiceMethod = serviceMethod
+	}
+
+	// 序列化
+	codecPlugin, ok := codec.Get(cn.codecType)
+	if !ok {
+		return nil, errors.New("codec plugin is not exist")
+	}
+	payload, err := codecPlugin.Encode(args)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("client encode payload error:%v", err))
+	}
+	// 压缩
+	cpr, ex := compressor.Get(cn.compressorType)
+	if !ex {
+		return nil, errors.New("compress plugin is not exist")
+	}
+	payload, err = cpr.Zip(payload)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("client compress payload error:%#v", err))
+	}
+	reqBody.Payload = payload
+	return &protocol.Message{
+		Header: reqHeader,
+		Body:   reqBody,
+	}, nil
+}
+
+func (cn *connection) newHeader(msgType protocol.MessageType, seq uint64) *protocol.Header {
+	header := &protocol.Header{
+		Start:          protocol.StartChar,
+		Version:        cn.version,
+		MessageType:    byte(msgType),
+		Seq:            seq,
+		CodecType:      byte(cn.codecType),
+		CompressorType: byte(cn.compressorType),
+	}
+	if cn.option.checksum {
+		header.Flags |= protocol.FlagChecksum
+	}
+	return header
+}
+
+// fragment 按协商的分片大小拆分消息
+// 超过协商的最大消息体大小时服务端会拒绝并关闭连接，在本地提前失败
+func (cn *connection) fragment(reqMsg *protocol.Message) ([]*protocol.Message, error) {
+	fragments := protocol.Fragment(reqMsg, int(cn.fragmentSize))
+	for _, fragment := range fragments {
+		bodySize := uint64(fragment.BodySize())
+		if cn.maxFrameSize > 0 && bodySize > uint64(cn.maxFrameSize) {
+			return nil, &protocol.FrameSizeError{Header: reqMsg.Header, Field: "body", Size: bodySize, Limit: cn.maxFrameSize}
+		}
+	}
+	return fragments, nil
+}
+
+// send 登记调用者并写入消息，返回nil时消息已经完整写入连接，之后等待响应
+// ctx结束后不再写入剩余的分片，返回错误时调用者已经移除
+func (cn *connection) send(ctx context.Context, reqMsg *protocol.Message, caller *Caller) error {
+	fragments, err := cn.fragment(reqMsg)
+	if err != nil {
+		return err
+	}
+
+	// 写入前登记，响应可能在写入返回前到达
+	seq := reqMsg.Header.Seq
+	if err = cn.registerCall(seq, caller); err != nil {
+		return err
+	}
+	// 逐个写入分片，期间其他调用的消息可以穿插发送
+	for i, fragment := range fragments {
+		if ctx.Err() != nil {
+			cn.removeCall(seq)
+			if i > 0 {
+				cn.abort(fragment)
+			}
+			return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		}
+		if err = cn.write(fragment); err != nil {
+			// 连接已经不可用，关闭后由接收协程通知其他调用
+			cn.removeCall(seq)
+			_ = cn.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// abort 放弃发送剩余的分片，fragment为第一个没有写入的分片
+// 先发送取消消息，服务端丢弃已经收到的分片，再发送空的最后一个分片，服务端收到后清除丢弃标记
+func (cn *connection) abort(fragment *protocol.Message) {
+	seq := fragment.Header.Seq
+	cn.cancel(seq)
+	header := *fragment.Header
+	header.Flags &^= protocol.FlagMore
+	last := &protocol.Message{
+		Header: &header,
+		Body:   &protocol.Body{},
+	}
+	if err := cn.write(last); err != nil {
+		log.Printf("rpc client: send the last fragment of seq:%d error:%v", seq, err)
+	}
+}
+
+// sendOneway 发送不需要响应的消息
+func (cn *connection) sendOneway(reqMsg *protocol.Message) error {
+	fragments, err := cn.fragment(reqMsg)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		err = cn.write(fragment)
+		if err != nil {
+			_ = cn.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// write 将消息写入连接
+func (cn *connection) write(msg *protocol.Message) error {
+	// 设置写超时
+	if cn.option.writeTimeout > 0 {
+		now := time.Now()
+		_ = cn.conn.SetWriteDeadline(now.Add(cn.option.writeTimeout))
+	}
+
+	cn.reqMutex.Lock()
+	defer cn.reqMutex.Unlock()
+	return cn.encoder.Encode(msg)
+}
+
+// receive 读取响应直到连接断开，断开后通知所有等待响应的调用并调用onBroken
+func (cn *connection) receive(onBroken func(cn *connection)) {
+	defer func() {
+		_ = cn.conn.Close()
+	}()
+	for {
+		callDone, err := cn.handleResponse()
+		// 调用出错
+		if err != nil && callDone != nil {
+			callDone <- err
+		}
+		// 客户端发生错误
+		if err != nil && callDone == nil {
+			cn.fail(err)
+			if onBroken != nil {
+				onBroken(cn)
+			}
+			break
+		}
+		// 正常调用结束
+		if err == nil && callDone != nil {
+			close(callDone)
+		}
+
+	}
+}
+
+func (cn *connection) handleResponse() (done chan error, err error) {
+	// 设置读超时
+	if cn.option.readTimeout > 0 {
+		now := time.Now()
+		_ = cn.conn.SetReadDeadline(now.Add(cn.option.readTimeout))
+	}
+	msg, err := cn.decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+	defer msg.Release()
+	// 不属于任何调用的错误，如消息校验和不一致，服务端会关闭连接
+	if msg.Header.Seq == 0 && msg.Body.Error != "" {
+		return nil, &RemoteError{Message: msg.Body.Error}
+	}
+	seq := msg.Header.Seq
+	// 重组分片，分片没有接收完时继续读取
+	msg, err = cn.assembler.Add(msg)
+	if err != nil {
+		// 未完成的分片占用过多内存，关闭连接
+		if errors.Is(err, protocol.ErrPendingSize) {
+			return nil, err
+		}
+		if caller, ok := cn.takeCall(seq); ok {
+			return caller.done, err
+		}
+		return nil, nil
+	}
+	if msg == nil {
+		return nil, nil
+	}
+	caller, ok := cn.takeCall(seq)
+	if !ok {
+		// 调用已经超时或取消，丢弃迟到的响应
+		log.Printf("rpc client: drop the response of seq:%d, the call is not exist", seq)
+		return nil, nil
+	}
+	// 响应携带的元数据，调用方等待结束后取走
+	if len(msg.Body.Metadata) > 0 {
+		cn.setTrailer(caller, metadata.New(msg.Body.Metadata))
+	}
+	// 服务端调用失败
+	if msg.Body.Error != "" {
+		return caller.done, &RemoteError{Message: msg.Body.Error}
+	}
+	switch protocol.MessageType(msg.Header.MessageType) {
+	case protocol.Response:
+		if msg.Header.MethodID != 0 && caller.method != "" {
+			cn.setMethodID(caller.method, msg.Header.MethodID)
+		}
+	case protocol.Heartbeat:
+		// 心跳回复不携带数据
+		return caller.done, nil
+	case protocol.Handshake:
+		// 只有握手调用接收握手回复，其他调用收到时返回错误
+		remote, ok := caller.Reply.(*protocol.HandshakeInfo)
+		if !ok {
+			return caller.done, fmt.Errorf("rpc client: unexpected handshake response of seq:%d", seq)
+		}
+		info, err := protocol.DecodeHandshake(msg.Body.Payload)
+		if err != nil {
+			return caller.done, err
+		}
+		*remote = *info
+		return caller.done, nil
+	default:
+		return caller.done, fmt.Errorf("rpc client: not support message type:%d", msg.Header.MessageType)
+	}
+	// 调用已经取出，之后的错误只属于该调用，不影响连接
+	// 解压
+	compressorType := compressor.CompressorType(msg.Header.CompressorType)
+	compressPlugin, ex := compressor.Get(compressorType)
+	if !ex {
+		err = errors.New("compressor plugin is not exist")
+		return caller.done, err
+	}
+	payload, err := compressPlugin.Unzip(msg.Body.Payload)
+	if err != nil {
+		return caller.done, err
+	}
+	// 消息体缓冲区会被归还，reply不能引用它
+	if msg.Owns(payload) {
+		payload = append([]byte(nil), payload...)
+	}
+	msg.Body.Payload = payload
+	// 反序列化
+	cType := codec.CodecType(msg.Header.CodecType)
+	codecPlugin, ok := codec.Get(cType)
+	if !ok {
+		err = errors.New("codec plugin is not exist")
+		return caller.done, err
+	}
+	err = codecPlugin.Decode(msg.Body.Payload, caller.Reply)
+	if err != nil {
+		log.Printf("client decode error:%#v", err)
+		return caller.done, err
+	}
+	return caller.done, nil
+}
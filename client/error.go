@@ -0,0 +1,15 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/15 10:20
+ */
+
+package client
+
+// RemoteError 服务端返回的错误，用于区分远程调用失败与本地的超时、连接错误
+type RemoteError struct {
+	Message string // 服务端的错误信息
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,166 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/28 10:15
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cyj19/sparrow/registry"
+	"reflect"
+	"time"
+)
+
+// FailMode XClient调用失败时的处理方式
+type FailMode int
+
+const (
+	Failfast  FailMode = iota // 直接返回错误
+	Failtry                   // 在同一个服务上重试
+	Failover                  // 依次尝试下一个服务
+	Forking                   // 同时调用多个服务，返回第一个成功的结果
+	Broadcast                 // 调用所有服务，全部成功才算成功
+)
+
+func (m FailMode) String() string {
+	switch m {
+	case Failfast:
+		return "failfast"
+	case Failtry:
+		return "failtry"
+	case Failover:
+		return "failover"
+	case Forking:
+		return "forking"
+	case Broadcast:
+		return "broadcast"
+	}
+	return fmt.Sprintf("FailMode(%d)", int(m))
+}
+
+// retryable 是否可以重试，服务端方法返回的错误和ctx结束不重试
+func retryable(ctx context.Context, err error) bool {
+	var remoteErr *RemoteError
+	return ctx.Err() == nil && !errors.As(err, &remoteErr)
+}
+
+// newReply 创建与reply类型相同的实例，并发调用多个服务时各自使用
+func newReply(reply interface{}) interface{} {
+	return reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+}
+
+// setReply 将成功的结果复制到调用方的reply
+func setReply(dst, src interface{}) {
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
+// callResult 并发调用时一个服务的结果
+type callResult struct {
+	reply interface{}
+	err   error
+}
+
+// callIndex 调用servers[index]，方法开启对冲时以下一个服务作为对冲请求的目标
+func (x *XClient) callIndex(ctx context.Context, servers []*registry.ServerItem, index int, serviceName, serviceMethod string, args, reply interface{}) error {
+	if x.hedger != nil && len(servers) > 1 && x.hedger.enabled(serviceName, serviceMethod) {
+		backup := servers[(index+1)%len(servers)]
+		return x.hedge(ctx, servers[index], backup, serviceName, serviceMethod, args, reply)
+	}
+	return x.callServer(ctx, servers[index], serviceName, serviceMethod, args, reply)
+}
+
+// callServer 在指定服务的连接池中获取连接并调用，配置了熔断器时记录调用结果
+func (x *XClient) callServer(ctx context.Context, server *registry.ServerItem, serviceName, serviceMethod string, args, reply interface{}) error {
+	p, b, err := x.pool(server)
+	if err != nil {
+		return err
+	}
+	if b != nil {
+		if !b.allow() {
+			return ErrBreakerOpen
+		}
+		start := time.Now()
+		defer func() {
+			b.done(err, time.Since(start))
+		}()
+	}
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	err = c.Call(ctx, serviceName, serviceMethod, args, reply)
+	return err
+}
+
+// failtry 在选中的服务上最多重试retries次
+func (x *XClient) failtry(ctx context.Context, servers []*registry.ServerItem, index int, serviceName, serviceMethod string, args, reply interface{}) error {
+	var err error
+	for i := 0; i <= x.option.retries; i++ {
+		err = x.callIndex(ctx, servers, index, serviceName, serviceMethod, args, reply)
+		if err == nil || !retryable(ctx, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// failover 从选中的服务开始，失败后依次尝试下一个服务，最多重试retries次
+func (x *XClient) failover(ctx context.Context, servers []*registry.ServerItem, index int, serviceName, serviceMethod string, args, reply interface{}) error {
+	var err error
+	for i := 0; i <= x.option.retries; i++ {
+		err = x.callIndex(ctx, servers, (index+i)%len(servers), serviceName, serviceMethod, args, reply)
+		if err == nil || !retryable(ctx, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// forking 同时调用所有服务，返回第一个成功的结果，全部失败时返回最后一个错误
+func (x *XClient) forking(ctx context.Context, servers []*registry.ServerItem, serviceName, serviceMethod string, args, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan callResult, len(servers))
+	for _, server := range servers {
+		go func(server *registry.ServerItem) {
+			r := newReply(reply)
+			err := x.callServer(ctx, server, serviceName, serviceMethod, args, r)
+			results <- callResult{reply: r, err: err}
+		}(server)
+	}
+
+	var err error
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			// 其他调用会被取消
+			setReply(reply, r.reply)
+			return nil
+		}
+		err = r.err
+	}
+	return err
+}
+
+// broadcast 同时调用所有服务，全部成功时返回第一个结果，否则返回一个错误
+func (x *XClient) broadcast(ctx context.Context, servers []*registry.ServerItem, serviceName, serviceMethod string, args, reply interface{}) error {
+	replies := make([]interface{}, len(servers))
+	calls := make([]*Call, len(servers))
+	for i, server := range servers {
+		replies[i] = newReply(reply)
+		server := server
+		calls[i] = goCall(serviceName, serviceMethod, args, replies[i], func(reply interface{}) error {
+			return x.callServer(ctx, server, serviceName, serviceMethod, args, reply)
+		})
+	}
+	if err := Wait(calls...); err != nil {
+		return err
+	}
+	setReply(reply, replies[0])
+	return nil
+}
@@ -0,0 +1,100 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/16 11:05
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cyj19/sparrow/codec"
+	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/protocol"
+	"log"
+)
+
+// handshakeInfo 客户端支持的能力，配置的插件优先
+func (cn *connection) handshakeInfo() *protocol.HandshakeInfo {
+	info := &protocol.HandshakeInfo{
+		Version:      protocol.Version,
+		Codecs:       []byte{byte(cn.option.codecType)},
+		Compressors:  []byte{byte(cn.option.compressorType)},
+		FragmentSize: uint32(cn.option.fragmentSize),
+	}
+	if cn.option.limit != nil {
+		info.MaxFrameSize = cn.option.limit.MaxBodySize
+		info.MaxMetadataSize = cn.option.limit.MaxMetadataSize
+		info.MaxErrorSize = cn.option.limit.MaxErrorSize
+	}
+	for _, cType := range codec.Types() {
+		if cType != cn.option.codecType {
+			info.Codecs = append(info.Codecs, byte(cType))
+		}
+	}
+	for _, cType := range compressor.Types() {
+		if cType != cn.option.compressorType {
+			info.Compressors = append(info.Compressors, byte(cType))
+		}
+	}
+	return info
+}
+
+// ErrIncompatibleServer 服务端在握手超时时间内没有回复，可能使用了不兼容的协议版本，如消息头格式不同的旧版本
+var ErrIncompatibleServer = errors.New("rpc client: the server does not answer the handshake, the protocol may be incompatible")
+
+// handshake 与服务端协商协议版本、插件和限制
+// 不支持握手但消息格式相同的服务端会回复错误，此时沿用客户端的配置
+// 消息格式不同的服务端无法解析握手，不会回复，握手超时后返回ErrIncompatibleServer
+func (cn *connection) handshake() error {
+	payload, err := protocol.EncodeHandshake(cn.handshakeInfo())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cn.option.handshakeTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	seq := cn.nextSeq()
+	defer func() {
+		cn.removeCall(seq)
+	}()
+
+	reqMsg := &protocol.Message{
+		Header: cn.newHeader(protocol.Handshake, seq),
+		Body: &protocol.Body{
+			Payload: payload,
+		},
+	}
+	remote := &protocol.HandshakeInfo{}
+	err = cn.send(ctx, reqMsg, &Caller{Reply: remote, done: done})
+	if err == nil {
+		err = cn.wait(ctx, done)
+	}
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		log.Printf("rpc client: server does not support handshake, use default option: %v", err)
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrIncompatibleServer, cn.server.Addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(remote.Codecs) == 0 {
+		return errors.New("rpc client: no codec supported by both client and server")
+	}
+	if len(remote.Compressors) == 0 {
+		return errors.New("rpc client: no compressor supported by both client and server")
+	}
+	cn.version = remote.Version
+	cn.codecType = codec.CodecType(remote.Codecs[0])
+	cn.compressorType = compressor.CompressorType(remote.Compressors[0])
+	cn.maxFrameSize = remote.MaxFrameSize
+	cn.fragmentSize = remote.FragmentSize
+	return nil
+}
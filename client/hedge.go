@@ -0,0 +1,128 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/31 10:00
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/cyj19/sparrow/registry"
+	"sync"
+	"time"
+)
+
+// HedgeConfig XClient对冲请求的配置
+// 开启对冲的方法在Delay内没有响应时，向下一个服务发送相同的请求，使用先到达的响应并取消另一个
+// 只应该对幂等的方法开启
+type HedgeConfig struct {
+	Delay    time.Duration // 发送对冲请求前的等待时间，通常设置为该方法耗时的p95
+	MaxRatio float64       // 对冲请求占调用数的最大比例，限制额外的负载，默认0.1
+	Methods  []string      // 开启对冲的方法，格式为serviceName.serviceMethod
+}
+
+func (c *HedgeConfig) validate() error {
+	if c.Delay <= 0 {
+		return errors.New("rpc client: the hedge delay must be positive")
+	}
+	if c.MaxRatio < 0 || c.MaxRatio > 1 {
+		return errors.New("rpc client: the hedge max ratio must be in [0, 1]")
+	}
+	return nil
+}
+
+// hedger 判断方法是否开启对冲，并按比例限制对冲请求的数量
+type hedger struct {
+	delay   time.Duration
+	ratio   float64
+	methods map[string]struct{}
+	mu      *sync.Mutex
+	tokens  float64 // 每次调用增加ratio，每个对冲请求消耗1
+}
+
+// maxHedgeTokens 积累的令牌上限，避免长时间没有对冲后突然发出大量对冲请求
+const maxHedgeTokens = 10
+
+func newHedger(config *HedgeConfig) *hedger {
+	ratio := config.MaxRatio
+	if ratio == 0 {
+		ratio = 0.1
+	}
+	methods := make(map[string]struct{}, len(config.Methods))
+	for _, method := range config.Methods {
+		methods[method] = struct{}{}
+	}
+	return &hedger{
+		delay:   config.Delay,
+		ratio:   ratio,
+		methods: methods,
+		mu:      new(sync.Mutex),
+	}
+}
+
+// enabled 方法是否开启对冲，开启时记录一次调用
+func (h *hedger) enabled(serviceName, serviceMethod string) bool {
+	if _, ok := h.methods[serviceName+"."+serviceMethod]; !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.ratio
+	if h.tokens > maxHedgeTokens {
+		h.tokens = maxHedgeTokens
+	}
+	return true
+}
+
+// allow 是否还能发送对冲请求
+func (h *hedger) allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// hedge 调用primary，超过等待时间没有响应时再调用backup，返回第一个成功的结果
+func (x *XClient) hedge(ctx context.Context, primary, backup *registry.ServerItem, serviceName, serviceMethod string, args, reply interface{}) error {
+	// 返回时取消还在进行的调用，客户端会通知服务端取消
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan callResult, 2)
+	launch := func(server *registry.ServerItem) {
+		r := newReply(reply)
+		go func() {
+			err := x.callServer(ctx, server, serviceName, serviceMethod, args, r)
+			results <- callResult{reply: r, err: err}
+		}()
+	}
+	launch(primary)
+	pending := 1
+
+	timer := time.NewTimer(x.hedger.delay)
+	defer timer.Stop()
+	timeout := timer.C
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				setReply(reply, r.reply)
+				return nil
+			}
+			if pending == 0 {
+				return r.err
+			}
+		case <-timeout:
+			timeout = nil
+			if x.hedger.allow() {
+				launch(backup)
+				pending++
+			}
+		}
+	}
+}
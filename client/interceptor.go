@@ -0,0 +1,26 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/29 10:05
+ */
+
+package client
+
+import "context"
+
+// Invoker 执行一次调用
+type Invoker func(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error
+
+// Interceptor 客户端拦截器，在调用前后执行自定义逻辑，调用invoker继续执行后面的拦截器和调用
+// 可以通过metadata.AppendToOutgoingContext添加元数据，或者不调用invoker直接返回
+type Interceptor func(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+// chainInterceptors 将拦截器和invoker组合为一个Invoker，第一个拦截器在最外层
+func chainInterceptors(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceName, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
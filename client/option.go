@@ -6,29 +6,244 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"github.com/cyj19/sparrow/balance"
 	"github.com/cyj19/sparrow/codec"
 	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/protocol"
 	"time"
 )
 
 // Option 客户端配置
 type Option struct {
-	loadBalance    balance.LoadBalancing     // 负载均衡插件
-	codecType      codec.CodecType           // 序列化插件
-	compressorType compressor.CompressorType // 压缩插件
-	readTimeout    time.Duration             // io读取超时时间
-	writeTimeout   time.Duration             // io写超时时间
-	connectTimeout time.Duration             // 连接超时时间
+	loadBalance      balance.LoadBalancing     // 负载均衡插件，nil表示使用服务发现自身的负载均衡
+	codecType        codec.CodecType           // 序列化插件
+	compressorType   compressor.CompressorType // 压缩插件
+	readTimeout      time.Duration             // io读取超时时间
+	writeTimeout     time.Duration             // io写超时时间
+	connectTimeout   time.Duration             // 连接超时时间
+	handshakeTimeout time.Duration             // 握手超时时间
+	limit            *protocol.Limit           // 解码响应时的大小限制
+	checksum         bool                      // 请求是否携带CRC32校验和
+	magic            bool                      // 请求的元数据是否携带字符串调用标识
+	fragmentSize     int                       // 分片大小，与服务端协商后payload超过该大小的请求拆分发送
+	poolSize         int                       // XClient与每个服务保持的最大连接数
+	idleTimeout      time.Duration             // XClient关闭空闲超过该时间的连接，0表示不关闭
+	maxLifetime      time.Duration             // XClient连接的最长使用时间，0表示不限制
+	reconnect        bool                      // 连接断开后是否自动重连
+	reconnectBackoff time.Duration             // 重连的初始退避时间，每次失败后翻倍
+	reconnectMaxWait time.Duration             // 重连的最大退避时间
+	reconnectQueue   bool                      // 重连期间新的调用等待重连结束，否则立即失败
+	failMode         FailMode                  // XClient调用失败时的处理方式
+	retries          int                       // Failtry和Failover的最大重试次数
+	interceptors     []Interceptor             // 客户端拦截器，按添加顺序从外到内执行
+	breaker          *BreakerConfig            // XClient每个服务的熔断器配置，nil表示不熔断
+	hedge            *HedgeConfig              // XClient对冲请求的配置，nil表示不对冲
 }
 
 func defaultOption() *Option {
 	return &Option{
-		loadBalance:    balance.NewRoundRobin(),
-		codecType:      codec.JSON,
-		compressorType: compressor.GZIP,
-		readTimeout:    3 * time.Minute,
-		writeTimeout:   1 * time.Minute,
-		connectTimeout: 1 * time.Minute,
+		codecType:        codec.JSON,
+		compressorType:   compressor.GZIP,
+		readTimeout:      3 * time.Minute,
+		writeTimeout:     1 * time.Minute,
+		connectTimeout:   1 * time.Minute,
+		handshakeTimeout: 5 * time.Second,
+		limit:            protocol.DefaultLimit,
+		fragmentSize:     1 << 20,
+		poolSize:         1,
+	}
+}
+
+// validate 检查配置是否有效
+func (o *Option) validate() error {
+	if _, ok := codec.Get(o.codecType); !ok {
+		return fmt.Errorf("rpc client: not have this codec type:%d", o.codecType)
+	}
+	if _, ok := compressor.Get(o.compressorType); !ok {
+		return fmt.Errorf("rpc client: not have this compressor type:%d", o.compressorType)
+	}
+	if o.readTimeout < 0 || o.writeTimeout < 0 || o.connectTimeout < 0 {
+		return errors.New("rpc client: the timeout must not be negative")
+	}
+	if o.handshakeTimeout <= 0 {
+		return errors.New("rpc client: the handshake timeout must be positive")
+	}
+	if o.fragmentSize < 0 {
+		return errors.New("rpc client: the fragment size must not be negative")
+	}
+	if o.poolSize < 1 {
+		return errors.New("rpc client: the pool size must be positive")
+	}
+	if o.idleTimeout < 0 || o.maxLifetime < 0 {
+		return errors.New("rpc client: the idle timeout and max lifetime must not be negative")
+	}
+	if o.failMode < Failfast || o.failMode > Broadcast {
+		return fmt.Errorf("rpc client: not support fail mode:%d", o.failMode)
+	}
+	if o.retries < 0 {
+		return errors.New("rpc client: the retries must not be negative")
+	}
+	if o.breaker != nil {
+		if err := o.breaker.validate(); err != nil {
+			return err
+		}
+	}
+	if o.hedge != nil {
+		if err := o.hedge.validate(); err != nil {
+			return err
+		}
+	}
+	if o.reconnect && (o.reconnectBackoff <= 0 || o.reconnectMaxWait < o.reconnectBackoff) {
+		return errors.New("rpc client: the reconnect backoff must be positive and not exceed the max wait")
+	}
+	return nil
+}
+
+// OptionSetter 快速设置Option
+type OptionSetter func(option *Option)
+
+// WithCodec 设置序列化插件，握手时优先使用
+func WithCodec(cType codec.CodecType) OptionSetter {
+	return func(option *Option) {
+		option.codecType = cType
+	}
+}
+
+// WithCompressor 设置压缩插件，握手时优先使用
+func WithCompressor(cType compressor.CompressorType) OptionSetter {
+	return func(option *Option) {
+		option.compressorType = cType
+	}
+}
+
+// WithReadTimeout 设置io读取超时时间，0表示不超时
+func WithReadTimeout(timeout time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.readTimeout = timeout
+	}
+}
+
+// WithWriteTimeout 设置io写超时时间，0表示不超时
+func WithWriteTimeout(timeout time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.writeTimeout = timeout
+	}
+}
+
+// WithConnectTimeout 设置连接超时时间，0表示不超时
+func WithConnectTimeout(timeout time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.connectTimeout = timeout
+	}
+}
+
+// WithHandshakeTimeout 设置握手超时时间，超时后按旧版本服务端处理
+func WithHandshakeTimeout(timeout time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.handshakeTimeout = timeout
+	}
+}
+
+// WithLoadBalance 设置负载均衡插件，从服务发现的所有服务中选择连接的服务
+func WithLoadBalance(lb balance.LoadBalancing) OptionSetter {
+	return func(option *Option) {
+		option.loadBalance = lb
+	}
+}
+
+// WithLimit 设置解码响应时的大小限制，nil表示不限制
+func WithLimit(limit *protocol.Limit) OptionSetter {
+	return func(option *Option) {
+		option.limit = limit
+	}
+}
+
+// WithChecksum 请求携带CRC32校验和，服务端的响应也会携带
+func WithChecksum() OptionSetter {
+	return func(option *Option) {
+		option.checksum = true
+	}
+}
+
+// WithMagic 每次调用生成字符串标识放入元数据的metadata.MagicKey，便于按字符串追踪调用
+func WithMagic() OptionSetter {
+	return func(option *Option) {
+		option.magic = true
+	}
+}
+
+// WithFragmentSize 设置分片大小，0表示不分片
+func WithFragmentSize(size int) OptionSetter {
+	return func(option *Option) {
+		option.fragmentSize = size
+	}
+}
+
+// WithPoolSize 设置XClient与每个服务保持的最大连接数，连接在需要时才建立
+func WithPoolSize(size int) OptionSetter {
+	return func(option *Option) {
+		option.poolSize = size
+	}
+}
+
+// WithIdleTimeout 设置XClient连接的空闲超时时间，0表示不关闭空闲连接
+func WithIdleTimeout(timeout time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.idleTimeout = timeout
+	}
+}
+
+// WithMaxLifetime 设置XClient连接的最长使用时间，到期后不再接收新的调用，0表示不限制
+func WithMaxLifetime(lifetime time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.maxLifetime = lifetime
+	}
+}
+
+// WithReconnect 连接断开后自动重连，backoff为初始退避时间，每次失败后翻倍直到maxWait
+// 第一次立即重连原来的服务，之后通过服务发现重新选择服务
+func WithReconnect(backoff, maxWait time.Duration) OptionSetter {
+	return func(option *Option) {
+		option.reconnect = true
+		option.reconnectBackoff = backoff
+		option.reconnectMaxWait = maxWait
+	}
+}
+
+// WithReconnectQueue 重连期间新的调用等待重连结束或ctx结束，默认立即返回ErrReconnecting
+func WithReconnectQueue() OptionSetter {
+	return func(option *Option) {
+		option.reconnectQueue = true
+	}
+}
+
+// WithFailMode 设置XClient调用失败时的处理方式，retries为Failtry和Failover的最大重试次数
+func WithFailMode(mode FailMode, retries int) OptionSetter {
+	return func(option *Option) {
+		option.failMode = mode
+		option.retries = retries
+	}
+}
+
+// WithInterceptor 添加客户端拦截器，先添加的拦截器在外层
+func WithInterceptor(interceptors ...Interceptor) OptionSetter {
+	return func(option *Option) {
+		option.interceptors = append(option.interceptors, interceptors...)
+	}
+}
+
+// WithBreaker XClient为每个服务创建熔断器，熔断的服务在选择时被跳过
+func WithBreaker(config BreakerConfig) OptionSetter {
+	return func(option *Option) {
+		option.breaker = config.withDefault()
+	}
+}
+
+// WithHedging XClient对config.Methods中的方法开启对冲请求，只应该对幂等的方法开启
+func WithHedging(config HedgeConfig) OptionSetter {
+	return func(option *Option) {
+		option.hedge = &config
 	}
 }
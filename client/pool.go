@@ -0,0 +1,153 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/25 10:10
+ */
+
+package client
+
+import (
+	"errors"
+	"github.com/cyj19/sparrow/registry"
+	"sync"
+	"time"
+)
+
+// pool 与一个服务保持的连接池
+// 选择进行中调用最少的连接，所有连接都在忙且没有达到上限时才建立新连接
+type pool struct {
+	server  *registry.ServerItem
+	option  *Option
+	mu      *sync.Mutex
+	clients []*Client
+	retired []*Client // 超过最长使用时间的连接，调用结束后关闭
+	dialing int       // 正在建立的连接数
+	closed  bool
+}
+
+var errPoolClosed = errors.New("rpc client: the connection pool is closed")
+
+func newPool(server *registry.ServerItem, option *Option) *pool {
+	return &pool{
+		server: server,
+		option: option,
+		mu:     new(sync.Mutex),
+	}
+}
+
+// get 获取一个连接，返回的连接已经记录为进行中，调用结束后需调用release
+// 在锁外建立新连接，建立期间其他调用仍然可以使用已有的连接
+func (p *pool) get() (*Client, error) {
+	p.mu.Lock()
+	p.reapLocked(time.Now())
+	least := p.leastLocked()
+	// 在锁内记录选中的连接为进行中，避免并发获取时选中同一个连接，也避免调用开始前被当作空闲连接关闭
+	if least != nil && (least.busy() == 0 || len(p.clients)+p.dialing >= p.option.poolSize) {
+		least.acquire()
+		p.mu.Unlock()
+		return least, nil
+	}
+	// 预留名额，避免同时建立的连接超过上限
+	p.dialing++
+	p.mu.Unlock()
+
+	// 重连时不能换到其他服务，也不能在x.mu之外使用共享的负载均衡
+	c, err := dial(nil, p.server, p.option)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if p.closed {
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, errPoolClosed
+	}
+	if err == nil && len(p.clients) < p.option.poolSize {
+		p.clients = append(p.clients, c)
+		c.acquire()
+		return c, nil
+	}
+	// 建立失败或其他调用已经填满连接池时，退回使用最空闲的连接
+	if err == nil {
+		_ = c.Close()
+	}
+	if least = p.leastLocked(); least != nil {
+		least.acquire()
+		return least, nil
+	}
+	return nil, err
+}
+
+// leastLocked 进行中调用最少的连接，调用方需持有p.mu
+func (p *pool) leastLocked() *Client {
+	var least *Client
+	for _, c := range p.clients {
+		if least == nil || c.busy() < least.busy() {
+			least = c
+		}
+	}
+	return least
+}
+
+// reap 关闭断开、空闲超时和超过最长使用时间的连接
+func (p *pool) reap() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reapLocked(time.Now())
+}
+
+func (p *pool) reapLocked(now time.Time) {
+	clients := p.clients[:0]
+	for _, c := range p.clients {
+		switch {
+		case c.Closed():
+			_ = c.Close()
+		case p.option.idleTimeout > 0 && c.idle() >= p.option.idleTimeout:
+			_ = c.Close()
+		case p.option.maxLifetime > 0 && now.Sub(c.created) >= p.option.maxLifetime:
+			// 不再接收新的调用，进行中的调用结束后关闭
+			p.retired = append(p.retired, c)
+		default:
+			clients = append(clients, c)
+		}
+	}
+	for i := len(clients); i < len(p.clients); i++ {
+		p.clients[i] = nil
+	}
+	p.clients = clients
+
+	retired := p.retired[:0]
+	for _, c := range p.retired {
+		if c.busy() == 0 {
+			_ = c.Close()
+			continue
+		}
+		retired = append(retired, c)
+	}
+	for i := len(retired); i < len(p.retired); i++ {
+		p.retired[i] = nil
+	}
+	p.retired = retired
+}
+
+// size 连接池中可用的连接数
+func (p *pool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.clients)
+}
+
+// close 关闭所有连接
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.clients {
+		_ = c.Close()
+	}
+	for _, c := range p.retired {
+		_ = c.Close()
+	}
+	p.clients = nil
+	p.retired = nil
+	p.closed = true
+}
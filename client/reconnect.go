@@ -0,0 +1,83 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/26 14:20
+ */
+
+package client
+
+import (
+	"github.com/cyj19/sparrow/registry"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// onBroken 当前连接断开时开始重连，等待响应的调用已经由连接通知失败
+func (c *Client) onBroken(cn *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.cn != cn || !c.Option.reconnect {
+		return
+	}
+	log.Printf("rpc client: the connection to %s is broken: %v, reconnecting", cn.server.Addr, cn.err)
+	c.ready = make(chan struct{})
+	go c.reconnect(cn.server)
+}
+
+// reconnect 按指数退避重连，直到成功或客户端被关闭
+func (c *Client) reconnect(server *registry.ServerItem) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(c.Option.reconnectBackoff, c.Option.reconnectMaxWait, attempt)):
+			case <-c.stop:
+				return
+			}
+			// 原来的服务可能已经下线，重新选择服务，连接池中的连接只重连原来的服务
+			// 同一时间只有一个重连协程，不会并发使用负载均衡
+			if c.discovery != nil {
+				if s, err := selectServer(c.discovery, c.Option.loadBalance); err == nil {
+					server = s
+				} else {
+					log.Printf("rpc client: reconnect select server error:%v", err)
+				}
+			}
+		}
+
+		cn, err := newConnection(server, c.Option, c.onBroken)
+		if err != nil {
+			log.Printf("rpc client: reconnect to %s error:%v", server.Addr, err)
+			continue
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			_ = cn.close()
+			return
+		}
+		// 替换前断开的连接不会触发onBroken，继续重连
+		if cn.broken() {
+			c.mu.Unlock()
+			continue
+		}
+		c.cn = cn
+		close(c.ready)
+		c.ready = nil
+		c.mu.Unlock()
+		log.Printf("rpc client: reconnected to %s", server.Addr)
+		return
+	}
+}
+
+// backoff 第attempt次重连前的等待时间，在[d/2, d]之间随机，避免多个客户端同时重连
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
@@ -0,0 +1,239 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/24 9:40
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/cyj19/sparrow/discovery"
+	"github.com/cyj19/sparrow/registry"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrXClientClosed = errors.New("rpc client: xclient is closed")
+
+// XClient 多服务客户端，每次调用通过服务发现和负载均衡选择服务
+// 每个服务对应一个连接池，服务列表变化时关闭已经下线的服务的连接
+type XClient struct {
+	option    *Option
+	discovery discovery.Discovery
+	mu        *sync.Mutex      // 保护pools，同时保证负载均衡插件不被并发调用
+	pools     map[string]*pool // key为服务的protocol@addr
+	breakers  map[string]*breaker
+	hedger    *hedger // 没有配置对冲时为nil
+	closed    bool
+	stop      chan struct{} // 关闭时停止清理连接的协程
+}
+
+func NewXClient(d discovery.Discovery, fns ...OptionSetter) (*XClient, error) {
+	option := defaultOption()
+	for _, fn := range fns {
+		fn(option)
+	}
+	if err := option.validate(); err != nil {
+		return nil, err
+	}
+	x := &XClient{
+		option:    option,
+		discovery: d,
+		mu:        new(sync.Mutex),
+		pools:     map[string]*pool{},
+		breakers:  map[string]*breaker{},
+		stop:      make(chan struct{}),
+	}
+	if option.hedge != nil {
+		x.hedger = newHedger(option.hedge)
+	}
+	if interval := reapInterval(option); interval > 0 {
+		go x.reapLoop(interval)
+	}
+	return x, nil
+}
+
+func serverKey(server *registry.ServerItem) string {
+	return server.Protocol + "@" + server.Addr
+}
+
+// Call 选择一个服务调用方法，失败时按配置的FailMode处理
+func (x *XClient) Call(ctx context.Context, serviceName, serviceMethod string, args, reply interface{}) error {
+	servers, index, err := x.selectServers()
+	if err != nil {
+		return err
+	}
+	switch x.option.failMode {
+	case Failtry:
+		return x.failtry(ctx, servers, index, serviceName, serviceMethod, args, reply)
+	case Failover:
+		return x.failover(ctx, servers, index, serviceName, serviceMethod, args, reply)
+	case Forking:
+		return x.forking(ctx, servers, serviceName, serviceMethod, args, reply)
+	case Broadcast:
+		return x.broadcast(ctx, servers, serviceName, serviceMethod, args, reply)
+	default:
+		return x.callIndex(ctx, servers, index, serviceName, serviceMethod, args, reply)
+	}
+}
+
+// Refresh 从注册中心更新服务列表，关闭已经下线的服务的连接
+func (x *XClient) Refresh() error {
+	err := x.discovery.Refresh()
+	if err != nil {
+		return err
+	}
+	servers, err := x.discovery.GetAll()
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.prune(servers)
+	return nil
+}
+
+// Close 关闭所有连接
+func (x *XClient) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	close(x.stop)
+	for key, p := range x.pools {
+		p.close()
+		delete(x.pools, key)
+	}
+	return nil
+}
+
+// selectServers 获取最新的服务列表，并通过负载均衡选择首先调用的服务
+func (x *XClient) selectServers() ([]*registry.ServerItem, int, error) {
+	servers, err := x.discovery.GetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil, 0, ErrXClientClosed
+	}
+	x.prune(servers)
+	// 跳过熔断的服务，Broadcast需要调用所有服务，熔断的服务作为失败返回ErrBreakerOpen
+	if x.option.breaker != nil && x.option.failMode != Broadcast {
+		available := make([]*registry.ServerItem, 0, len(servers))
+		for _, server := range servers {
+			if x.breakerLocked(server).available() {
+				available = append(available, server)
+			}
+		}
+		if len(available) == 0 && len(servers) > 0 {
+			return nil, 0, ErrBreakerOpen
+		}
+		servers = available
+	}
+	if lb := x.option.loadBalance; lb != nil && len(servers) > 0 {
+		return servers, lb.GetModeResult(len(servers)), nil
+	}
+	server, err := x.discovery.Get()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, s := range servers {
+		if serverKey(s) == serverKey(server) {
+			return servers, i, nil
+		}
+	}
+	// 服务发现选择的服务已经熔断
+	if x.option.breaker != nil {
+		return servers, 0, nil
+	}
+	return append([]*registry.ServerItem{server}, servers...), 0, nil
+}
+
+// pool 获取服务的连接池和熔断器，不存在时创建，没有配置熔断器时返回的熔断器为nil
+func (x *XClient) pool(server *registry.ServerItem) (*pool, *breaker, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil, nil, ErrXClientClosed
+	}
+	key := serverKey(server)
+	p, ok := x.pools[key]
+	if !ok {
+		p = newPool(server, x.option)
+		x.pools[key] = p
+	}
+	var b *breaker
+	if x.option.breaker != nil {
+		b = x.breakerLocked(server)
+	}
+	return p, b, nil
+}
+
+// breakerLocked 获取服务的熔断器，不存在时创建，调用方需持有x.mu
+func (x *XClient) breakerLocked(server *registry.ServerItem) *breaker {
+	key := serverKey(server)
+	b, ok := x.breakers[key]
+	if !ok {
+		b = newBreaker(x.option.breaker, server)
+		x.breakers[key] = b
+	}
+	return b
+}
+
+// prune 关闭不在servers中的服务的连接，调用方需持有x.mu
+func (x *XClient) prune(servers []*registry.ServerItem) {
+	alive := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		alive[serverKey(server)] = struct{}{}
+	}
+	for key := range x.breakers {
+		if _, ok := alive[key]; !ok {
+			delete(x.breakers, key)
+		}
+	}
+	for key, p := range x.pools {
+		if _, ok := alive[key]; !ok {
+			log.Printf("rpc client: server %s is offline, close the connection", key)
+			p.close()
+			delete(x.pools, key)
+		}
+	}
+}
+
+// reapInterval 清理连接的间隔，没有设置空闲超时和最长使用时间时为0
+func reapInterval(option *Option) time.Duration {
+	interval := option.idleTimeout
+	if interval == 0 || (option.maxLifetime > 0 && option.maxLifetime < interval) {
+		interval = option.maxLifetime
+	}
+	return interval / 2
+}
+
+// reapLoop 定期清理空闲超时和超过最长使用时间的连接
+func (x *XClient) reapLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.stop:
+			return
+		case <-ticker.C:
+		}
+		x.mu.Lock()
+		pools := make([]*pool, 0, len(x.pools))
+		for _, p := range x.pools {
+			pools = append(pools, p)
+		}
+		x.mu.Unlock()
+		for _, p := range pools {
+			p.reap()
+		}
+	}
+}
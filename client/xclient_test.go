@@ -0,0 +1,429 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/24 11:05
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/cyj19/sparrow/balance"
+	"github.com/cyj19/sparrow/discovery"
+	"github.com/cyj19/sparrow/registry"
+	"github.com/cyj19/sparrow/server"
+	"github.com/cyj19/sparrow/transport"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestXClient_Call(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	first, second := startServer(t), startServer(t)
+	d.Register(first)
+	d.Register(second)
+	x, err := NewXClient(d, WithLoadBalance(balance.NewRoundRobin()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		reply := &ArithReply{}
+		err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: i, B: 1}, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.C != i+1 {
+			t.Fatalf("expect %d, got %d", i+1, reply.C)
+		}
+	}
+	if len(x.pools) != 2 {
+		t.Fatalf("expect 2 connections, got %d", len(x.pools))
+	}
+
+	// 服务下线后关闭它的连接
+	_ = d.Update([]*registry.ServerItem{second})
+	if err = x.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := x.pools[serverKey(first)]; ok || len(x.pools) != 1 {
+		t.Fatalf("expect only the connection of %s", serverKey(second))
+	}
+	reply := &ArithReply{}
+	if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = x.Close()
+	if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != ErrXClientClosed {
+		t.Fatalf("expect ErrXClientClosed, got %v", err)
+	}
+}
+
+func TestXClient_Pool(t *testing.T) {
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	server := startServer(t)
+	d.Register(server)
+	x, err := NewXClient(d, WithPoolSize(2), WithIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 串行调用只需要一个连接
+	for i := 0; i < 3; i++ {
+		if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := x.pools[serverKey(server)]
+	if n := p.size(); n != 1 {
+		t.Fatalf("expect 1 connection, got %d", n)
+	}
+
+	// 连接在忙时建立新的连接，但不超过上限
+	blockCtx, blockCancel := context.WithCancel(ctx)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_ = x.Call(blockCtx, "Arith", "Block", &ArithArgs{}, &ArithReply{})
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := p.size(); n != 2 {
+		t.Fatalf("expect 2 connections, got %d", n)
+	}
+	blockCancel()
+	for i := 0; i < 3; i++ {
+		<-blocked
+	}
+
+	// 空闲超时后关闭连接
+	time.Sleep(300 * time.Millisecond)
+	if n := p.size(); n != 0 {
+		t.Fatalf("expect idle connections closed, got %d", n)
+	}
+}
+
+func TestXClient_PoolSpread(t *testing.T) {
+	option := defaultOption()
+	WithPoolSize(4)(option)
+	p := newPool(startServer(t), option)
+	defer p.close()
+
+	// 获取的连接立即记录为进行中，连续获取的调用均匀分布到各个连接
+	got := map[*Client]int{}
+	for i := 0; i < 8; i++ {
+		c, err := p.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[c]++
+	}
+	if len(got) != 4 {
+		t.Fatalf("expect 4 connections, got %d", len(got))
+	}
+	for c, n := range got {
+		if n != 2 || c.busy() != 2 {
+			t.Fatalf("expect 2 calls on each connection, got %d", n)
+		}
+		c.release()
+		c.release()
+	}
+	if c, err := p.get(); err != nil || c.busy() != 1 {
+		t.Fatalf("expect an idle connection, got %v", err)
+	}
+}
+
+func TestXClient_PoolSlowDial(t *testing.T) {
+	// 接受连接但不回复握手，建立连接需要等待握手超时
+	addr := filepath.Join(t.TempDir(), "slow.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	option := defaultOption()
+	WithHandshakeTimeout(300 * time.Millisecond)(option)
+	p := newPool(&registry.ServerItem{Protocol: string(transport.UNIX), Addr: addr}, option)
+	defer p.close()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := p.get()
+		got <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// 建立连接期间不持有锁
+	start := time.Now()
+	if n := p.size(); n != 0 {
+		t.Fatalf("expect no connection, got %d", n)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("expect the pool not locked while dialing, waited %s", d)
+	}
+	// 不回复握手的服务端视为不兼容
+	if err = <-got; !errors.Is(err, ErrIncompatibleServer) {
+		t.Fatalf("expect ErrIncompatibleServer, got %v", err)
+	}
+	if n := p.size(); n != 0 {
+		t.Fatalf("expect no connection, got %d", n)
+	}
+}
+
+func TestXClient_PoolReconnect(t *testing.T) {
+	first, second := startServer(t), startServer(t)
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	_ = d.Update([]*registry.ServerItem{first, second})
+	x, err := NewXClient(d, WithLoadBalance(balance.NewRoundRobin()), WithReconnect(10*time.Millisecond, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	p, _, err := x.pool(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 服务不可达后连接池中的连接只重连原来的服务，不会换到其他服务
+	_ = os.Remove(first.Addr)
+	_ = c.cn.close()
+	time.Sleep(200 * time.Millisecond)
+	c.mu.Lock()
+	server, reconnecting := c.cn.server, c.ready != nil
+	c.mu.Unlock()
+	if server != first || !reconnecting {
+		t.Fatalf("expect reconnecting to %s, got %s", first.Addr, server.Addr)
+	}
+}
+
+// firstBalance 总是选择第一个服务
+type firstBalance struct{}
+
+func (firstBalance) GetModeResult(n int) int {
+	return 0
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	dead := &registry.ServerItem{Protocol: string(transport.UNIX), Addr: filepath.Join(t.TempDir(), "none.sock")}
+	alive := startServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cases := []struct {
+		mode    FailMode
+		servers []*registry.ServerItem
+		ok      bool
+	}{
+		{Failfast, []*registry.ServerItem{dead, alive}, false},
+		{Failtry, []*registry.ServerItem{dead, alive}, false},
+		{Failover, []*registry.ServerItem{dead, alive}, true},
+		{Forking, []*registry.ServerItem{dead, alive}, true},
+		{Broadcast, []*registry.ServerItem{dead, alive}, false},
+		{Broadcast, []*registry.ServerItem{alive, startServer(t)}, true},
+	}
+	for _, tc := range cases {
+		d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+		_ = d.Update(tc.servers)
+		x, err := NewXClient(d, WithLoadBalance(firstBalance{}), WithFailMode(tc.mode, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &ArithReply{}
+		err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply)
+		if tc.ok && (err != nil || reply.C != 3) {
+			t.Fatalf("%s: expect 3, got %d %v", tc.mode, reply.C, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("%s: expect error", tc.mode)
+		}
+		_ = x.Close()
+	}
+
+	// 服务端方法返回的错误不会重试
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	_ = d.Update([]*registry.ServerItem{alive})
+	x, err := NewXClient(d, WithFailMode(Failover, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	err = x.Call(ctx, "Arith", "Div", &ArithArgs{A: 1, B: 0}, &ArithReply{})
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("expect RemoteError, got %v", err)
+	}
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	dead := &registry.ServerItem{Protocol: string(transport.UNIX), Addr: filepath.Join(t.TempDir(), "none.sock")}
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	_ = d.Update([]*registry.ServerItem{dead, startServer(t)})
+	changes := make(chan BreakerState, 10)
+	x, err := NewXClient(d,
+		WithLoadBalance(firstBalance{}),
+		WithFailMode(Failover, 1),
+		WithBreaker(BreakerConfig{
+			MinRequests: 2,
+			OpenTimeout: 200 * time.Millisecond,
+			OnStateChange: func(server *registry.ServerItem, from, to BreakerState) {
+				if server == dead {
+					changes <- to
+				}
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	call := func() {
+		reply := &ArithReply{}
+		if err := x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil || reply.C != 3 {
+			t.Fatalf("expect 3, got %d %v", reply.C, err)
+		}
+	}
+	expect := func(state BreakerState) {
+		select {
+		case to := <-changes:
+			if to != state {
+				t.Fatalf("expect %s, got %s", state, to)
+			}
+		default:
+			t.Fatalf("expect %s", state)
+		}
+	}
+
+	// 连续失败后熔断，之后不再选择该服务
+	call()
+	call()
+	expect(BreakerOpen)
+	call()
+	if len(changes) != 0 {
+		t.Fatal("expect the open server is skipped")
+	}
+
+	// 熔断超时后放行试探调用，失败后再次熔断
+	time.Sleep(250 * time.Millisecond)
+	call()
+	expect(BreakerHalfOpen)
+	expect(BreakerOpen)
+}
+
+func TestXClient_BreakerBroadcast(t *testing.T) {
+	dead := &registry.ServerItem{Protocol: string(transport.UNIX), Addr: filepath.Join(t.TempDir(), "none.sock")}
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	_ = d.Update([]*registry.ServerItem{dead, startServer(t)})
+	x, err := NewXClient(d,
+		WithFailMode(Broadcast, 0),
+		WithBreaker(BreakerConfig{MinRequests: 1}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{}); err == nil {
+		t.Fatal("expect the broadcast to fail")
+	}
+	// 熔断的服务不会被跳过，广播仍然失败
+	if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, &ArithReply{}); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expect ErrBreakerOpen, got %v", err)
+	}
+}
+
+func TestXClient_BreakerCanceledProbe(t *testing.T) {
+	b := newBreaker(BreakerConfig{MinRequests: 1, OpenTimeout: time.Millisecond}.withDefault(), &registry.ServerItem{})
+	if !b.allow() {
+		t.Fatal("expect the closed breaker to allow the call")
+	}
+	b.done(errors.New("broken"), 0)
+	time.Sleep(5 * time.Millisecond)
+
+	// 取消的试探调用归还名额，之后仍然可以试探
+	if !b.allow() {
+		t.Fatal("expect the half-open breaker to allow a probe")
+	}
+	b.done(context.Canceled, 0)
+	if !b.available() || !b.allow() {
+		t.Fatal("expect the canceled probe to give back its slot")
+	}
+	b.done(nil, 0)
+	if b.state != BreakerClosed {
+		t.Fatalf("expect %s, got %s", BreakerClosed, b.state)
+	}
+}
+
+func TestXClient_Hedging(t *testing.T) {
+	canceled := make(chan struct{}, 10)
+	slow := func(ctx context.Context, info *server.RequestInfo, args, reply interface{}, handler server.Handler) error {
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			canceled <- struct{}{}
+			return ctx.Err()
+		}
+		return handler(ctx, args, reply)
+	}
+	d := discovery.NewSimpleDiscovery(balance.NewRoundRobin())
+	_ = d.Update([]*registry.ServerItem{startServer(t, server.UseInterceptor(slow)), startServer(t)})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	call := func(ratio float64) time.Duration {
+		x, err := NewXClient(d, WithLoadBalance(firstBalance{}), WithHedging(HedgeConfig{
+			Delay:    50 * time.Millisecond,
+			MaxRatio: ratio,
+			Methods:  []string{"Arith.Add"},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer x.Close()
+		start := time.Now()
+		reply := &ArithReply{}
+		if err = x.Call(ctx, "Arith", "Add", &ArithArgs{A: 1, B: 2}, reply); err != nil || reply.C != 3 {
+			t.Fatalf("expect 3, got %d %v", reply.C, err)
+		}
+		return time.Since(start)
+	}
+
+	// 对冲请求先返回，慢的请求被取消
+	if elapsed := call(1); elapsed >= 400*time.Millisecond {
+		t.Fatalf("expect the hedged response, took %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expect the slow call canceled")
+	}
+
+	// 超过额外负载的限制时不发送对冲请求
+	if elapsed := call(0.1); elapsed < 400*time.Millisecond {
+		t.Fatalf("expect no hedged request, took %v", elapsed)
+	}
+}
@@ -0,0 +1,290 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/23 10:20
+ */
+
+// sparrow-dump 解析sparrow协议的原始字节流，逐帧打印消息头、元数据、服务方法以及解压和反序列化后的payload
+//
+// 读取抓包得到的原始字节流：
+//
+//	sparrow-dump -file capture.bin
+//	cat capture.bin | sparrow-dump -file -
+//
+// 输入只能是一个方向的原始TCP负载，即按顺序拼接的sparrow消息，不支持pcap、pcapng等抓包文件格式，
+// 需要先用Wireshark的Follow TCP Stream(保存为Raw)或tcpflow等工具导出单个方向的数据
+//
+// 作为TCP代理转发流量，同时打印两个方向的消息：
+//
+//	sparrow-dump -listen :8788 -target 127.0.0.1:8787
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/cyj19/sparrow/codec"
+	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/metadata"
+	"github.com/cyj19/sparrow/protocol"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var messageTypeNames = map[protocol.MessageType]string{
+	protocol.Request:   "Request",
+	protocol.Response:  "Response",
+	protocol.Heartbeat: "Heartbeat",
+	protocol.Oneway:    "Oneway",
+	protocol.Cancel:    "Cancel",
+	protocol.Stream:    "Stream",
+	protocol.Handshake: "Handshake",
+}
+
+func main() {
+	file := flag.String("file", "", "read the raw TCP payload of one direction (not pcap), - for stdin")
+	listen := flag.String("listen", "", "proxy listen address")
+	target := flag.String("target", "", "proxy target address")
+	flag.Parse()
+
+	switch {
+	case *file != "":
+		err := dumpFile(*file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case *listen != "" && *target != "":
+		err := proxy(*listen, *target)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// dumpFile 解析文件中的所有消息
+func dumpFile(name string) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return newDumper(os.Stdout, "").dump(r)
+}
+
+// proxy 转发listen收到的连接到target，并打印两个方向的消息
+func proxy(listen, target string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("sparrow-dump: proxy %s -> %s", listen, target)
+	var out sync.Mutex
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go proxyConn(conn, target, os.Stdout, &out)
+	}
+}
+
+// proxyConn 转发一个连接，两个方向的消息都打印到w
+func proxyConn(conn net.Conn, target string, w io.Writer, out *sync.Mutex) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Printf("sparrow-dump: dial %s error:%v", target, err)
+		return
+	}
+	defer upstream.Close()
+
+	name := conn.RemoteAddr().String()
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn, prefix string) {
+		defer func() {
+			done <- struct{}{}
+		}()
+		// 边读边转发，解析失败后继续转发剩余的字节
+		tee := io.TeeReader(src, dst)
+		d := newDumper(w, prefix)
+		d.out = out
+		err := d.dump(tee)
+		if err != nil {
+			log.Printf("sparrow-dump: %s %v", prefix, err)
+			_, _ = io.Copy(dst, src)
+		}
+		if c, ok := dst.(*net.TCPConn); ok {
+			_ = c.CloseWrite()
+		}
+	}
+	go pipe(upstream, conn, name+" ->")
+	go pipe(conn, upstream, name+" <-")
+	<-done
+	<-done
+}
+
+// dumper 解析一个方向的字节流，分片重组后再打印payload
+type dumper struct {
+	w         io.Writer
+	prefix    string
+	out       *sync.Mutex // 多个连接共用输出时保证一条消息的内容连续
+	assembler *protocol.Assembler
+}
+
+func newDumper(w io.Writer, prefix string) *dumper {
+	return &dumper{
+		w:         w,
+		prefix:    prefix,
+		assembler: protocol.NewAssembler(protocol.DefaultLimit),
+	}
+}
+
+// dump 逐帧解析直到EOF
+func (d *dumper) dump(r io.Reader) error {
+	for i := 1; ; i++ {
+		msg, err := protocol.DecodeMessage(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+		d.print(i, msg)
+	}
+}
+
+func (d *dumper) print(n int, msg *protocol.Message) {
+	var b strings.Builder
+	h := msg.Header
+	msgType := protocol.MessageType(h.MessageType)
+	typeName, ok := messageTypeNames[msgType]
+	if !ok {
+		typeName = fmt.Sprintf("Unknown(%d)", h.MessageType)
+	}
+	fmt.Fprintf(&b, "%s#%d %s seq=%d version=%d flags=%s codec=%d compressor=%d method_id=%d\n",
+		d.prefix, n, typeName, h.Seq, h.Version, flagsString(h.Flags), h.CodecType, h.CompressorType, h.MethodID)
+	fmt.Fprintf(&b, "  sizes: metadata=%d service=%d method=%d error=%d payload=%d\n",
+		h.MetadataSize, h.ServiceNameSize, h.ServiceMethodSize, h.ErrorSize, h.PayLoadSize)
+	types := make([]int, 0, len(h.Extensions))
+	for t := range h.Extensions {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		fmt.Fprintf(&b, "  extension[%d]: %s\n", t, formatBytes(h.Extensions[protocol.ExtensionType(t)]))
+	}
+	if msg.Body.ServiceName != "" || msg.Body.ServiceMethod != "" {
+		fmt.Fprintf(&b, "  call: %s.%s\n", msg.Body.ServiceName, msg.Body.ServiceMethod)
+	}
+	if magic, ok := msg.Body.Metadata[metadata.MagicKey]; ok {
+		fmt.Fprintf(&b, "  magic: %s\n", magic)
+	}
+	keys := make([]string, 0, len(msg.Body.Metadata))
+	for k := range msg.Body.Metadata {
+		if k != metadata.MagicKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  metadata: %s=%s\n", k, msg.Body.Metadata[k])
+	}
+	if msg.Body.Error != "" {
+		fmt.Fprintf(&b, "  error: %s\n", msg.Body.Error)
+	}
+
+	// 取消消息与被取消的请求序列号相同，不参与重组
+	if msgType == protocol.Cancel {
+		d.assembler.Remove(h.Seq)
+	} else if msg, err := d.assembler.Add(msg); err != nil {
+		fmt.Fprintf(&b, "  assemble error: %v\n", err)
+	} else if msg == nil {
+		fmt.Fprintf(&b, "  fragment, waiting for more\n")
+	} else if len(msg.Body.Payload) > 0 {
+		fmt.Fprintf(&b, "  payload: %s\n", payloadString(msg))
+	}
+
+	if d.out != nil {
+		d.out.Lock()
+		defer d.out.Unlock()
+	}
+	_, _ = io.WriteString(d.w, b.String())
+}
+
+func flagsString(flags byte) string {
+	var names []string
+	if flags&protocol.FlagChecksum != 0 {
+		names = append(names, "checksum")
+	}
+	if flags&protocol.FlagMore != 0 {
+		names = append(names, "more")
+	}
+	if flags&protocol.FlagExtension != 0 {
+		names = append(names, "extension")
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%#02x(%s)", flags, strings.Join(names, "|"))
+}
+
+// payloadString 解压并使用注册的序列化插件解析payload，失败时打印原始字节
+func payloadString(msg *protocol.Message) string {
+	payload := msg.Body.Payload
+	// 握手消息的payload是不经过压缩的JSON
+	if protocol.MessageType(msg.Header.MessageType) == protocol.Handshake {
+		info, err := protocol.DecodeHandshake(payload)
+		if err != nil {
+			return fmt.Sprintf("%s (decode handshake error:%v)", formatBytes(payload), err)
+		}
+		return fmt.Sprintf("%+v", *info)
+	}
+
+	compressPlugin, ok := compressor.Get(compressor.CompressorType(msg.Header.CompressorType))
+	if !ok {
+		return fmt.Sprintf("%s (unknown compressor)", formatBytes(payload))
+	}
+	data, err := compressPlugin.Unzip(payload)
+	if err != nil {
+		return fmt.Sprintf("%s (unzip error:%v)", formatBytes(payload), err)
+	}
+
+	cType := codec.CodecType(msg.Header.CodecType)
+	codecPlugin, ok := codec.Get(cType)
+	if !ok {
+		return fmt.Sprintf("%s (unknown codec)", formatBytes(data))
+	}
+	if cType == codec.JSON {
+		var v interface{}
+		if err = codecPlugin.Decode(data, &v); err != nil {
+			return fmt.Sprintf("%s (decode error:%v)", formatBytes(data), err)
+		}
+		return fmt.Sprintf("%v", v)
+	}
+	var v []byte
+	if err = codecPlugin.Decode(data, &v); err != nil {
+		return fmt.Sprintf("%s (decode error:%v)", formatBytes(data), err)
+	}
+	return formatBytes(v)
+}
+
+// formatBytes 可打印的内容按字符串输出，否则输出十六进制
+func formatBytes(data []byte) string {
+	if utf8.Valid(data) {
+		return fmt.Sprintf("%q", data)
+	}
+	return hex.EncodeToString(data)
+}
@@ -0,0 +1,180 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/23 15:40
+ */
+
+package main
+
+import (
+	"bytes"
+	"github.com/cyj19/sparrow/codec"
+	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/metadata"
+	"github.com/cyj19/sparrow/protocol"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestMessage 构建一个使用JSON序列化和GZIP压缩的消息
+func newTestMessage(t *testing.T, msgType protocol.MessageType, seq uint64, v interface{}) *protocol.Message {
+	codecPlugin, _ := codec.Get(codec.JSON)
+	payload, err := codecPlugin.Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressPlugin, _ := compressor.Get(compressor.GZIP)
+	if payload, err = compressPlugin.Zip(payload); err != nil {
+		t.Fatal(err)
+	}
+	return &protocol.Message{
+		Header: &protocol.Header{
+			Start:          protocol.StartChar,
+			Version:        protocol.Version,
+			MessageType:    byte(msgType),
+			Seq:            seq,
+			CodecType:      byte(codec.JSON),
+			CompressorType: byte(compressor.GZIP),
+		},
+		Body: &protocol.Body{
+			Metadata:      map[string]string{"tenant": "sparrow", metadata.MagicKey: "magic-1"},
+			ServiceName:   "Arith",
+			ServiceMethod: "Add",
+			Payload:       payload,
+		},
+	}
+}
+
+func encode(t *testing.T, w io.Writer, msgs ...*protocol.Message) {
+	for _, msg := range msgs {
+		data, err := protocol.EncodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	var buf bytes.Buffer
+	// 带校验和与扩展字段的完整消息
+	request := newTestMessage(t, protocol.Request, 1, map[string]int{"A": 1, "B": 2})
+	request.Header.Flags |= protocol.FlagChecksum
+	request.Header.SetExtension(protocol.ExtensionType(7), []byte("trace"))
+	encode(t, &buf, request)
+	// 分片的消息与其他消息交错
+	large := newTestMessage(t, protocol.Response, 2, map[string]string{"C": strings.Repeat("x", 200)})
+	fragments := protocol.Fragment(large, 8)
+	encode(t, &buf, fragments[0], &protocol.Message{Header: &protocol.Header{Start: protocol.StartChar, Version: protocol.Version, MessageType: byte(protocol.Heartbeat), Seq: 3}, Body: &protocol.Body{}})
+	encode(t, &buf, fragments[1:]...)
+	// 取消后剩余的分片被丢弃
+	canceled := protocol.Fragment(newTestMessage(t, protocol.Request, 4, map[string]string{"C": strings.Repeat("y", 200)}), 8)
+	encode(t, &buf, canceled[0], &protocol.Message{Header: &protocol.Header{Start: protocol.StartChar, Version: protocol.Version, MessageType: byte(protocol.Cancel), Seq: 4}, Body: &protocol.Body{}})
+	encode(t, &buf, canceled[1:]...)
+
+	var out strings.Builder
+	if err := newDumper(&out, "").dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	result := out.String()
+	for _, expect := range []string{
+		"#1 Request seq=1 version=2 flags=0x05(checksum|extension)",
+		`extension[7]: "trace"`,
+		"call: Arith.Add",
+		"magic: magic-1",
+		"metadata: tenant=sparrow",
+		"payload: map[A:1 B:2]",
+		"#2 Response seq=2 version=2 flags=0x02(more)",
+		"#3 Heartbeat seq=3",
+		"payload: map[C:" + strings.Repeat("x", 200) + "]",
+		"Cancel seq=4",
+	} {
+		if !strings.Contains(result, expect) {
+			t.Fatalf("expect %q in output:\n%s", expect, result)
+		}
+	}
+	if strings.Contains(result, "yyyy") {
+		t.Fatalf("expect the canceled message dropped:\n%s", result)
+	}
+	// 被取消消息的分片都不会完成重组
+	if expect, n := len(fragments)-1+len(canceled), strings.Count(result, "fragment, waiting for more"); n != expect {
+		t.Fatalf("expect %d pending fragments, got %d:\n%s", expect, n, result)
+	}
+}
+
+func TestDumpChecksumMismatch(t *testing.T) {
+	request := newTestMessage(t, protocol.Request, 1, map[string]int{"A": 1})
+	request.Header.Flags |= protocol.FlagChecksum
+	data, err := protocol.EncodeMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	var out strings.Builder
+	if err = newDumper(&out, "").dump(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "frame 1") {
+		t.Fatalf("expect frame 1 checksum error, got %v", err)
+	}
+}
+
+func TestProxyConn(t *testing.T) {
+	// 目标服务原样回复收到的字节
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var out bytes.Buffer
+	var mu sync.Mutex
+	proxied := make(chan struct{})
+	go func() {
+		defer close(proxied)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		proxyConn(conn, target.Addr().String(), &out, &mu)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var sent bytes.Buffer
+	encode(t, io.MultiWriter(conn, &sent), newTestMessage(t, protocol.Request, 1, map[string]int{"A": 1, "B": 2}))
+	_ = conn.(*net.TCPConn).CloseWrite()
+	// 转发的字节不被修改
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent.Bytes()) {
+		t.Fatal("expect the proxied bytes unchanged")
+	}
+	<-proxied
+
+	result := out.String()
+	for _, expect := range []string{" ->#1 Request seq=1", " <-#1 Request seq=1", "payload: map[A:1 B:2]"} {
+		if !strings.Contains(result, expect) {
+			t.Fatalf("expect %q in output:\n%s", expect, result)
+		}
+	}
+}
@@ -5,6 +5,8 @@
 
 package codec
 
+import "sort"
+
 func init() {
 	defaultManager.register(JSON, &JsonCodec{})
 	defaultManager.register(BYTE, &ByteCodec{})
@@ -43,3 +45,15 @@ func Get(cType CodecType) (Codec, bool) {
 	c, ok := defaultManager.codecMap[cType]
 	return c, ok
 }
+
+// Types 返回已注册的序列化类型
+func Types() []CodecType {
+	types := make([]CodecType, 0, len(defaultManager.codecMap))
+	for cType := range defaultManager.codecMap {
+		types = append(types, cType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
@@ -5,7 +5,10 @@
 
 package compressor
 
-import "errors"
+import (
+	"errors"
+	"sort"
+)
 
 func init() {
 	defaultManager.register(GZIP, &Gzip{})
@@ -41,6 +44,18 @@ func Register(cType CompressorType, compressor Compressor) error {
 	return defaultManager.register(cType, compressor)
 }
 
+// Types 返回已注册的压缩类型
+func Types() []CompressorType {
+	types := make([]CompressorType, 0, len(defaultManager.compressorMap))
+	for cType := range defaultManager.compressorMap {
+		types = append(types, cType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}
+
 func (m *compressorManager) register(cType CompressorType, compressor Compressor) error {
 	if _, ok := m.compressorMap[cType]; ok {
 		return errors.New("compressor is registered")
@@ -12,7 +12,6 @@ import (
 	"github.com/cyj19/sparrow/client"
 	"github.com/cyj19/sparrow/discovery"
 	"log"
-	"sync"
 	"time"
 )
 
@@ -30,25 +29,20 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	wg := sync.WaitGroup{}
-
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
 
+	// 异步调用，等待所有调用结束
+	calls := make([]*client.Call, 0, 10)
 	for i := 1; i < 11; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			name := fmt.Sprintf("cyj%d", i)
-			reqArgs := RequestArg{Name: name}
-			respReply := ResponseReply{}
-			err := c.Call(ctx, "HelloWorld", "Hello", &reqArgs, &respReply)
-			if err != nil {
-				log.Printf("call error:%v", err)
-			}
-			fmt.Println(respReply)
-		}(i)
+		reqArgs := &RequestArg{Name: fmt.Sprintf("cyj%d", i)}
+		calls = append(calls, c.Go(ctx, "HelloWorld", "Hello", reqArgs, &ResponseReply{}))
+	}
+	if err = client.Wait(calls...); err != nil {
+		log.Printf("call error:%v", err)
+	}
+	for _, call := range calls {
+		fmt.Println(*call.Reply.(*ResponseReply))
 	}
-
-	wg.Wait()
 
 }
@@ -0,0 +1,121 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/15 15:40
+ */
+
+package metadata
+
+import (
+	"context"
+	"errors"
+)
+
+// MagicKey 可选的字符串调用标识，需要按字符串追踪调用时放入元数据，请求和响应通过消息头的序列号关联
+const MagicKey = "sparrow-magic"
+
+// TimeoutKey 客户端调用剩余的超时时间，格式与time.Duration.String相同，服务端据此设置方法ctx的截止时间
+const TimeoutKey = "sparrow-timeout"
+
+// MD 每次调用携带的元数据，类似HTTP头，如链路ID、认证令牌、租户ID、调用方名称
+type MD map[string]string
+
+// New 根据map创建元数据，会拷贝一份避免共享
+func New(m map[string]string) MD {
+	md := make(MD, len(m))
+	for k, v := range m {
+		md[k] = v
+	}
+	return md
+}
+
+// Pairs 根据键值对创建元数据，kv的长度必须是偶数
+func Pairs(kv ...string) MD {
+	if len(kv)%2 == 1 {
+		panic("metadata: Pairs got the odd number of input pairs")
+	}
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+func (md MD) Set(key, value string) {
+	md[key] = value
+}
+
+func (md MD) Copy() MD {
+	return New(md)
+}
+
+// Join 合并多个元数据，后面的值覆盖前面的
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type trailerKey struct{}
+
+// NewOutgoingContext 客户端在ctx中附加需要发送的元数据
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在ctx已有的发送元数据上追加键值对
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+// FromOutgoingContext 获取ctx中需要发送的元数据
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+// NewIncomingContext 服务端在ctx中放入请求携带的元数据
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// FromIncomingContext 服务端方法获取请求携带的元数据
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
+
+// NewTrailerContext 在ctx中放入响应元数据的容器
+// 服务端用于收集方法设置的响应元数据，客户端用于接收响应携带回来的元数据
+func NewTrailerContext(ctx context.Context) (context.Context, MD) {
+	md := MD{}
+	return context.WithValue(ctx, trailerKey{}, md), md
+}
+
+// FromTrailerContext 获取ctx中的响应元数据容器
+func FromTrailerContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(trailerKey{}).(MD)
+	return md, ok
+}
+
+// SetTrailer 服务端方法设置需要随响应带回的元数据
+func SetTrailer(ctx context.Context, md MD) error {
+	trailer, ok := FromTrailerContext(ctx)
+	if !ok {
+		return errors.New("metadata: trailer is not exist in context")
+	}
+	for k, v := range md {
+		trailer[k] = v
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/18 10:30
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// checksumWriter 写入数据的同时计算CRC32
+type checksumWriter struct {
+	w   messageWriter
+	sum uint32
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.sum = crc32.Update(c.sum, crc32.IEEETable, p)
+	return c.w.Write(p)
+}
+
+func (c *checksumWriter) WriteString(s string) (int, error) {
+	c.sum = crc32.Update(c.sum, crc32.IEEETable, []byte(s))
+	return c.w.WriteString(s)
+}
+
+// writeSum 在消息末尾写入校验和
+func (c *checksumWriter) writeSum() error {
+	var sumData [ChecksumSize]byte
+	binary.BigEndian.PutUint32(sumData[:], c.sum)
+	_, err := c.w.Write(sumData[:])
+	return err
+}
+
+// verifyChecksum 读取消息末尾的校验和，与按顺序对data计算的结果比较
+func verifyChecksum(r io.Reader, data ...[]byte) error {
+	sumData := make([]byte, ChecksumSize)
+	_, err := io.ReadFull(r, sumData)
+	if err != nil {
+		return err
+	}
+	var sum uint32
+	for _, d := range data {
+		sum = crc32.Update(sum, crc32.IEEETable, d)
+	}
+	if sum != binary.BigEndian.Uint32(sumData) {
+		return ErrChecksum
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/22 15:30
+ */
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// ExtensionType 消息头扩展字段的类型
+// 新增的字段使用新的类型，不认识该类型的解码器会跳过它，不需要修改Version
+type ExtensionType byte
+
+// Extension 获取消息头的扩展字段
+func (h *Header) Extension(t ExtensionType) ([]byte, bool) {
+	value, ok := h.Extensions[t]
+	return value, ok
+}
+
+// SetExtension 设置消息头的扩展字段，value的长度不能超过65535
+func (h *Header) SetExtension(t ExtensionType, value []byte) {
+	if h.Extensions == nil {
+		h.Extensions = make(map[ExtensionType][]byte)
+	}
+	h.Extensions[t] = value
+}
+
+// extensionsSize 编码后扩展区域的大小，包括长度前缀，没有扩展字段时为0
+func extensionsSize(extensions map[ExtensionType][]byte) int {
+	if len(extensions) == 0 {
+		return 0
+	}
+	size := 4
+	for _, value := range extensions {
+		size += 3 + len(value)
+	}
+	return size
+}
+
+// writeExtensions 按类型排序写入扩展区域
+func writeExtensions(w messageWriter, extensions map[ExtensionType][]byte) error {
+	if len(extensions) == 0 {
+		return nil
+	}
+	types := make([]ExtensionType, 0, len(extensions))
+	for t, value := range extensions {
+		if len(value) > math.MaxUint16 {
+			return fmt.Errorf("the extension %d size %d exceeds %d", t, len(value), math.MaxUint16)
+		}
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+
+	data := make([]byte, 4, extensionsSize(extensions))
+	binary.BigEndian.PutUint32(data, uint32(cap(data)-4))
+	for _, t := range types {
+		value := extensions[t]
+		data = append(data, byte(t), 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(value)))
+		data = append(data, value...)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readExtensions 读取并解析扩展区域，返回包括长度前缀的原始数据用于计算校验和
+func readExtensions(r io.Reader, header *Header, limit *Limit) ([]byte, error) {
+	sizeData := make([]byte, 4)
+	_, err := io.ReadFull(r, sizeData)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(sizeData)
+	if limit != nil && limit.MaxExtensionSize > 0 && size > limit.MaxExtensionSize {
+		return nil, &FrameSizeError{Header: header, Field: "extension", Size: uint64(size), Limit: limit.MaxExtensionSize}
+	}
+	data := make([]byte, 4+size)
+	copy(data, sizeData)
+	_, err = io.ReadFull(r, data[4:])
+	if err != nil {
+		return nil, err
+	}
+	header.Extensions, err = parseExtensions(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// parseExtensions 解析扩展字段，所有类型都会保留，由使用方决定是否认识
+func parseExtensions(data []byte) (map[ExtensionType][]byte, error) {
+	extensions := make(map[ExtensionType][]byte)
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errors.New("the extension is not valid")
+		}
+		t := ExtensionType(data[0])
+		size := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+		if len(data) < size {
+			return nil, errors.New("the extension is not valid")
+		}
+		extensions[t] = data[:size:size]
+		data = data[size:]
+	}
+	return extensions, nil
+}
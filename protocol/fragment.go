@@ -0,0 +1,176 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/21 10:15
+ */
+
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Fragment 将payload超过size的消息拆分为多个分片，分片共享消息头的序列号
+// 第一个分片携带扩展字段、元数据、名称和错误信息，之后的分片只携带payload，除最后一个分片外都设置FlagMore
+// size为0或payload不超过size时返回原消息
+func Fragment(message *Message, size int) []*Message {
+	payload := message.Body.Payload
+	if size <= 0 || len(payload) <= size {
+		return []*Message{message}
+	}
+
+	n := (len(payload) + size - 1) / size
+	fragments := make([]*Message, 0, n)
+	for i := 0; i < n; i++ {
+		start := i * size
+		end := start + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		header := *message.Header
+		body := &Body{}
+		if i == 0 {
+			*body = *message.Body
+		} else {
+			header.Extensions = nil
+		}
+		body.Payload = payload[start:end]
+		if i < n-1 {
+			header.Flags |= FlagMore
+		} else {
+			header.Flags &^= FlagMore
+		}
+		fragments = append(fragments, &Message{Header: &header, Body: body})
+	}
+	return fragments
+}
+
+// ErrPendingSize 未完成重组的消息占用的总大小超过限制，无法继续接收该连接上的分片
+var ErrPendingSize = errors.New("the pending fragments size exceeds the limit")
+
+// Assembler 按序列号重组分片，同一个连接上不同调用的分片可以交错到达
+// 同一个Assembler不能并发使用
+type Assembler struct {
+	maxSize    uint64 // 重组后payload的最大字节数，0表示不限制
+	maxPending uint64 // 所有未完成重组的消息占用的最大字节数，0表示不限制
+	size       uint64 // 所有未完成重组的消息占用的字节数
+	pending    map[uint64]*assembly
+}
+
+type assembly struct {
+	message *Message
+	payload []byte
+	size    uint64 // 占用的字节数，包括一个消息头
+	dropped bool   // 超过大小限制或调用被取消，丢弃剩余的分片
+}
+
+// NewAssembler 按limit限制重组后的消息大小和未完成重组的消息占用的总大小，limit为nil表示不限制
+func NewAssembler(limit *Limit) *Assembler {
+	a := &Assembler{
+		pending: map[uint64]*assembly{},
+	}
+	if limit != nil {
+		a.maxSize = uint64(limit.MaxMessageSize)
+		a.maxPending = uint64(limit.MaxPendingSize)
+	}
+	return a
+}
+
+// Add 添加一个消息，返回重组后的完整消息，分片还没有接收完时返回nil
+// 超过大小限制时返回*FrameSizeError，该序列号剩余的分片会被丢弃
+// 未完成重组的消息占用的总大小超过限制时返回ErrPendingSize，调用方应关闭连接
+func (a *Assembler) Add(message *Message) (*Message, error) {
+	seq := message.Header.Seq
+	more := message.Header.Flags&FlagMore != 0
+	pending, ok := a.pending[seq]
+	// 没有分片的完整消息
+	if !ok && !more {
+		return message, nil
+	}
+
+	if !ok {
+		// 每个未完成的消息至少占用一个消息头，避免大量只发送第一个分片的序列号
+		if err := a.reserve(HeaderSize); err != nil {
+			message.Release()
+			return nil, err
+		}
+		pending = &assembly{
+			message: message,
+			size:    HeaderSize,
+		}
+		a.pending[seq] = pending
+	}
+	if pending.dropped {
+		if !more {
+			a.remove(seq, pending)
+		}
+		message.Release()
+		return nil, nil
+	}
+
+	size := uint64(len(pending.payload)) + uint64(len(message.Body.Payload))
+	if a.maxSize > 0 && size > a.maxSize {
+		a.drop(pending)
+		if !more {
+			a.remove(seq, pending)
+		}
+		message.Release()
+		return nil, &FrameSizeError{Header: pending.message.Header, Field: "message", Size: size, Limit: uint32(a.maxSize)}
+	}
+	if !more {
+		a.remove(seq, pending)
+	} else if err := a.reserve(uint64(len(message.Body.Payload))); err != nil {
+		message.Release()
+		return nil, err
+	} else {
+		pending.size += uint64(len(message.Body.Payload))
+	}
+	// 分片的payload引用解码缓冲区，拷贝后归还
+	pending.payload = append(pending.payload, message.Body.Payload...)
+	message.Release()
+
+	if more {
+		return nil, nil
+	}
+	result := pending.message
+	result.Header.Flags &^= FlagMore
+	result.Body.Payload = pending.payload
+	return result, nil
+}
+
+// reserve 为未完成重组的消息占用n个字节
+func (a *Assembler) reserve(n uint64) error {
+	if a.maxPending > 0 && a.size+n > a.maxPending {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrPendingSize, a.size+n, a.maxPending)
+	}
+	a.size += n
+	return nil
+}
+
+// drop 丢弃已经收到的payload，只保留丢弃标记
+func (a *Assembler) drop(pending *assembly) {
+	pending.dropped = true
+	a.size -= pending.size - HeaderSize
+	pending.size = HeaderSize
+	pending.payload = nil
+}
+
+func (a *Assembler) remove(seq uint64, pending *assembly) {
+	delete(a.pending, seq)
+	a.size -= pending.size
+}
+
+// Remove 丢弃序列号对应的未完成的分片，如调用被取消
+// 保留丢弃标记直到最后一个分片到达，避免之后到达的分片被当作新的消息重组
+func (a *Assembler) Remove(seq uint64) {
+	pending, ok := a.pending[seq]
+	if !ok {
+		return
+	}
+	a.drop(pending)
+}
+
+// Pending 未完成重组的消息数量
+func (a *Assembler) Pending() int {
+	return len(a.pending)
+}
@@ -0,0 +1,77 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/16 10:12
+ */
+
+package protocol
+
+import "encoding/json"
+
+// HandshakeInfo 建立连接时交换的协商信息，固定使用json编码，与序列化插件无关
+// 客户端发送自身支持的能力，服务端回复双方协商后的结果
+type HandshakeInfo struct {
+	Version         byte   `json:"version"`           // 协议版本
+	Codecs          []byte `json:"codecs"`            // 支持的序列化类型，按优先级排列
+	Compressors     []byte `json:"compressors"`       // 支持的压缩类型，按优先级排列
+	MaxFrameSize    uint32 `json:"max_frame_size"`    // 单个消息体的最大字节数，0表示不限制
+	FragmentSize    uint32 `json:"fragment_size"`     // 分片的payload大小，0表示不支持分片
+	MaxMetadataSize uint32 `json:"max_metadata_size"` // 元数据的最大字节数，0表示不限制
+	MaxErrorSize    uint32 `json:"max_error_size"`    // 错误信息的最大字节数，0表示不限制
+}
+
+func EncodeHandshake(info *HandshakeInfo) ([]byte, error) {
+	return json.Marshal(info)
+}
+
+func DecodeHandshake(data []byte) (*HandshakeInfo, error) {
+	info := &HandshakeInfo{}
+	err := json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Negotiate 根据双方的能力协商出共同支持的版本、插件和限制
+// 插件的优先级以local为准
+func Negotiate(local, remote *HandshakeInfo) *HandshakeInfo {
+	info := &HandshakeInfo{
+		Version:     local.Version,
+		Codecs:      intersect(local.Codecs, remote.Codecs),
+		Compressors: intersect(local.Compressors, remote.Compressors),
+		// 大小限制取双方中较小的一个
+		MaxFrameSize:    minLimit(local.MaxFrameSize, remote.MaxFrameSize),
+		MaxMetadataSize: minLimit(local.MaxMetadataSize, remote.MaxMetadataSize),
+		MaxErrorSize:    minLimit(local.MaxErrorSize, remote.MaxErrorSize),
+	}
+	if remote.Version < info.Version {
+		info.Version = remote.Version
+	}
+	// 双方都支持分片时才使用，取较小的分片大小
+	info.FragmentSize = local.FragmentSize
+	if remote.FragmentSize < info.FragmentSize {
+		info.FragmentSize = remote.FragmentSize
+	}
+	return info
+}
+
+// minLimit 较小的限制，0表示不限制
+func minLimit(a, b uint32) uint32 {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func intersect(a, b []byte) []byte {
+	result := make([]byte, 0, len(a))
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				result = append(result, x)
+				break
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/16 15:20
+ */
+
+package protocol
+
+import "fmt"
+
+// Limit 解码消息时对消息体和各个字段的大小限制，0表示不限制
+type Limit struct {
+	MaxBodySize          uint32 // 消息体总大小
+	MaxMetadataSize      uint32 // 元数据大小
+	MaxServiceNameSize   uint32 // 服务名称大小
+	MaxServiceMethodSize uint32 // 服务方法大小
+	MaxErrorSize         uint32 // 错误信息大小
+	MaxPayloadSize       uint32 // 函数参数大小
+	MaxMessageSize       uint32 // 分片重组后函数参数的总大小
+	MaxExtensionSize     uint32 // 消息头扩展区域大小
+	MaxPendingSize       uint32 // 一个连接上所有未完成重组的消息的总大小
+}
+
+// DefaultLimit 默认的大小限制，重组后的消息不超过单个消息体的大小
+// 需要传输更大的消息时通过server.UseLimit和client.WithLimit调大MaxMessageSize和MaxPendingSize
+var DefaultLimit = &Limit{
+	MaxBodySize:          64 << 20,
+	MaxMetadataSize:      64 << 10,
+	MaxServiceNameSize:   1 << 10,
+	MaxServiceMethodSize: 1 << 10,
+	MaxErrorSize:         64 << 10,
+	MaxPayloadSize:       64 << 20,
+	MaxMessageSize:       64 << 20,
+	MaxExtensionSize:     4 << 10,
+	MaxPendingSize:       256 << 20,
+}
+
+// FrameSizeError 消息的大小超过限制
+type FrameSizeError struct {
+	Header *Header // 超过限制的消息头，用于回复错误
+	Field  string  // 超过限制的字段
+	Size   uint64  // 字段的实际大小
+	Limit  uint32  // 字段的限制大小
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("the message %s size %d exceeds the limit %d", e.Field, e.Size, e.Limit)
+}
+
+// Check 检查消息头声明的各个字段大小是否超过限制
+func (l *Limit) Check(header *Header) error {
+	if l == nil {
+		return nil
+	}
+	fields := []struct {
+		name  string
+		size  uint32
+		limit uint32
+	}{
+		{"metadata", header.MetadataSize, l.MaxMetadataSize},
+		{"serviceName", header.ServiceNameSize, l.MaxServiceNameSize},
+		{"serviceMethod", header.ServiceMethodSize, l.MaxServiceMethodSize},
+		{"error", header.ErrorSize, l.MaxErrorSize},
+		{"payload", header.PayLoadSize, l.MaxPayloadSize},
+	}
+	for _, f := range fields {
+		if f.limit > 0 && f.size > f.limit {
+			return &FrameSizeError{Header: header, Field: f.name, Size: uint64(f.size), Limit: f.limit}
+		}
+	}
+	bodySize := header.BodySize()
+	if l.MaxBodySize > 0 && bodySize > uint64(l.MaxBodySize) {
+		return &FrameSizeError{Header: header, Field: "body", Size: bodySize, Limit: l.MaxBodySize}
+	}
+	return nil
+}
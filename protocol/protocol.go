@@ -6,57 +6,126 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"sort"
 )
 
 // 消息协议设计 使用前缀长度法
 /**
 Header:
-| start | version | codecType | compressorType | magicSize | serviceNameSize | serviceMethodSize | payloadSize |
-| 0x03  |   0x01  |     1     |        1       |     4     |         4       |          4        |      4      |
+| start | version | messageType | flags | codecType | compressorType | seq | methodID | metadataSize | serviceNameSize | serviceMethodSize | errorSize | payloadSize |
+| 0x03  |   0x01  |      1      |   1   |     1     |        1       |  8  |     4    |       4      |         4       |          4        |     4     |      4      |
+
+methodID: 服务端为每个服务方法分配的编号，客户端得知编号后只发送编号，serviceName和serviceMethod可以为空
 
 Body:
-| magic | serviceName | serviceMethod | payload |
-|   x   |     x       |       x       |    x    |
+| metadata | serviceName | serviceMethod | error | payload |
+|     x    |     x       |       x       |   x   |    x    |
+
+Fragment: payload较大时拆分为多个分片，分片之间可以穿插其他调用的消息，flags包含FlagMore表示后面还有相同序列号的分片
+第一个分片携带元数据、名称和错误信息，之后的分片只携带payload
+
+Extension: flags包含FlagExtension时，消息头和消息体之间是扩展区域，由长度前缀和若干TLV字段组成
+解码器根据长度前缀可以整体跳过，不认识的类型也可以逐个跳过，新增字段不需要修改Version
+| extensionSize | type | length | value | ...
+|       4       |   1  |    2   |   x   | ...
+
+Checksum: flags包含FlagChecksum时，消息体后面紧跟对消息头、扩展区域和消息体计算的CRC32(IEEE)
+| checksum |
+|     4    |
+
+Metadata: 按key排序后依次写入每个键值对
+| keySize | key | valueSize | value | ...
+|    4    |  x  |     4     |   x   | ...
 
 */
 
 const (
-	HeaderSize = 20
-	StartChar  = byte(3)
+	HeaderSize   = 38
+	ChecksumSize = 4
+	StartChar    = byte(3)
+	Version      = byte(2) // 当前的协议版本，版本2起消息头为38字节，与版本1的20字节消息头不兼容
+)
+
+// 消息头的标志位
+const (
+	FlagChecksum  byte = 1 << iota // 消息末尾携带CRC32校验和
+	FlagMore                       // 消息被拆分为多个分片，后面还有相同序列号的分片
+	FlagExtension                  // 消息头后面紧跟扩展区域
+)
+
+// ErrChecksum 消息的校验和不一致，消息在传输过程中被篡改或损坏
+var ErrChecksum = errors.New("the message checksum mismatch")
+
+// MessageType 消息类型
+type MessageType byte
+
+const (
+	Request   MessageType = iota // 请求
+	Response                     // 响应
+	Heartbeat                    // 心跳
+	Oneway                       // 单向调用，不需要响应
+	Cancel                       // 取消调用
+	Stream                       // 流
+	Handshake                    // 握手
 )
 
 // Header 定义消息头
 type Header struct {
 	Start             byte   // 起始符
 	Version           byte   // 版本号
+	MessageType       byte   // 消息类型
+	Flags             byte   // 标志位
 	CodecType         byte   // 序列化类型
 	CompressorType    byte   // 压缩类型
-	MagicSize         uint32 // 魔法值大小
+	Seq               uint64 // 序列号，用于关联请求和响应，每个连接内递增，0表示不属于任何调用
+	MethodID          uint32 // 服务方法编号，0表示使用服务名称和方法名称
+	MetadataSize      uint32 // 元数据大小
 	ServiceNameSize   uint32 // 服务名称大小
 	ServiceMethodSize uint32 // 服务方法大小
+	ErrorSize         uint32 // 错误信息大小
 	PayLoadSize       uint32 // 函数参数大小
+
+	Extensions map[ExtensionType][]byte // 扩展字段，编码时非空则设置FlagExtension
 }
 
 // Body 定义消息体
 type Body struct {
-	Magic         string // 魔法值
-	ServiceName   string // 服务名称
-	ServiceMethod string // 服务方法
-	Payload       []byte // 函数参数
+	Metadata      map[string]string // 元数据
+	ServiceName   string            // 服务名称
+	ServiceMethod string            // 服务方法
+	Error         string            // 错误信息，服务端调用失败时填充
+	Payload       []byte            // 函数参数
 }
 
 // Message 定义消息
 type Message struct {
 	Header *Header
 	Body   *Body
+	buf    *[]byte // 解码时从缓冲池获取的消息体缓冲区，Payload与其共享内存
+}
+
+// BodySize 消息体的总大小，使用uint64避免溢出
+func (h *Header) BodySize() uint64 {
+	return uint64(h.MetadataSize) + uint64(h.ServiceNameSize) +
+		uint64(h.ServiceMethodSize) + uint64(h.ErrorSize) + uint64(h.PayLoadSize)
 }
 
-// DecodeMessage 解码消息
+// DecodeMessage 使用默认的大小限制解码消息
 func DecodeMessage(r io.Reader) (*Message, error) {
-	headerData := make([]byte, HeaderSize)
+	return DecodeMessageWithLimit(r, DefaultLimit)
+}
+
+// DecodeMessageWithLimit 解码消息，消息大小超过限制时返回*FrameSizeError，limit为nil表示不限制
+func DecodeMessageWithLimit(r io.Reader, limit *Limit) (*Message, error) {
+	return decodeMessage(r, make([]byte, HeaderSize), limit, false)
+}
+
+// decodeMessage 解码消息，pooled为true时消息体缓冲区从缓冲池获取，使用完需要调用Message.Release归还
+func decodeMessage(r io.Reader, headerData []byte, limit *Limit, pooled bool) (*Message, error) {
 	// 读取标志位
 	_, err := io.ReadFull(r, headerData[:1])
 	if err != nil {
@@ -78,23 +147,51 @@ func DecodeMessage(r io.Reader) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
-	bodySize := header.MagicSize + header.ServiceNameSize + header.ServiceMethodSize + header.PayLoadSize
-	bodyData := make([]byte, bodySize)
+	// 分配内存前检查大小，避免恶意的消息头导致内存耗尽
+	err = limit.Check(header)
+	if err != nil {
+		return nil, err
+	}
+	// 读取扩展区域
+	var extensionData []byte
+	if header.Flags&FlagExtension != 0 {
+		extensionData, err = readExtensions(r, header, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	message := &Message{
+		Header: header,
+	}
+	var bodyData []byte
+	if pooled {
+		message.buf = getBuffer(int(header.BodySize()))
+		bodyData = *message.buf
+	} else {
+		bodyData = make([]byte, header.BodySize())
+	}
 	// 读取消息体的数据
 	_, err = io.ReadFull(r, bodyData)
 	if err != nil {
+		message.Release()
 		return nil, err
 	}
 
-	// 解码消息体
-	body, err := DecodeBody(bodyData, header)
+	// 校验和不一致时消息头声明的大小也不可信，由调用方决定是否关闭连接
+	if header.Flags&FlagChecksum != 0 {
+		err = verifyChecksum(r, headerData, extensionData, bodyData)
+		if err != nil {
+			message.Release()
+			return nil, err
+		}
+	}
+
+	// 解码消息体，bodyData只属于当前消息，payload直接引用不再拷贝
+	message.Body, err = decodeBody(bodyData, header)
 	if err != nil {
+		message.Release()
 		return nil, err
 	}
-	message := &Message{
-		Header: header,
-		Body:   body,
-	}
 	return message, nil
 }
 
@@ -102,94 +199,218 @@ func DecodeHeader(data []byte) (*Header, error) {
 	header := &Header{
 		Start:          data[0],
 		Version:        data[1],
-		CodecType:      data[2],
-		CompressorType: data[3],
+		MessageType:    data[2],
+		Flags:          data[3],
+		CodecType:      data[4],
+		CompressorType: data[5],
 	}
 	// 大端字符序转为uint32
-	header.MagicSize = binary.BigEndian.Uint32(data[4:8])
-	header.ServiceNameSize = binary.BigEndian.Uint32(data[8:12])
-	header.ServiceMethodSize = binary.BigEndian.Uint32(data[12:16])
-	header.PayLoadSize = binary.BigEndian.Uint32(data[16:20])
+	header.Seq = binary.BigEndian.Uint64(data[6:14])
+	header.MethodID = binary.BigEndian.Uint32(data[14:18])
+	header.MetadataSize = binary.BigEndian.Uint32(data[18:22])
+	header.ServiceNameSize = binary.BigEndian.Uint32(data[22:26])
+	header.ServiceMethodSize = binary.BigEndian.Uint32(data[26:30])
+	header.ErrorSize = binary.BigEndian.Uint32(data[30:34])
+	header.PayLoadSize = binary.BigEndian.Uint32(data[34:38])
 	return header, nil
 }
 
+// DecodeBody 解码消息体，所有字段都会拷贝，不引用data
 func DecodeBody(data []byte, header *Header) (*Body, error) {
-	body := &Body{}
+	body, err := decodeBody(data, header)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, len(body.Payload))
+	copy(payload, body.Payload)
+	body.Payload = payload
+	return body, nil
+}
 
-	magicSize := header.MagicSize
-	serviceNameSize := header.ServiceNameSize
-	serviceMethodSize := header.ServiceMethodSize
-	payloadSize := header.PayLoadSize
+// decodeBody 解码消息体，字符串字段会拷贝，payload引用data
+func decodeBody(data []byte, header *Header) (*Body, error) {
+	body := &Body{}
 
 	var startIndex uint32 = 0
-	endIndex := startIndex + magicSize
-	length := endIndex - startIndex
-	// 创建新的切片进行拷贝，避免操作同一个底层数组
-	magic := make([]byte, length)
-	copy(magic, data[startIndex:endIndex])
-	body.Magic = string(magic)
+	endIndex := startIndex + header.MetadataSize
+	metadata, err := decodeMetadata(data[startIndex:endIndex])
+	if err != nil {
+		return nil, err
+	}
+	body.Metadata = metadata
 
 	startIndex = endIndex
-	endIndex = startIndex + serviceNameSize
-	length = endIndex - startIndex
-	// 创建新的切片进行拷贝，避免操作同一个底层数组
-	serviceName := make([]byte, length)
-	copy(serviceName, data[startIndex:endIndex])
-	body.ServiceName = string(serviceName)
+	endIndex = startIndex + header.ServiceNameSize
+	body.ServiceName = string(data[startIndex:endIndex])
 
 	startIndex = endIndex
-	endIndex = startIndex + serviceMethodSize
-	length = endIndex - startIndex
-	// 创建新的切片进行拷贝，避免操作同一个底层数组
-	serviceMethod := make([]byte, length)
-	copy(serviceMethod, data[startIndex:endIndex])
-	body.ServiceMethod = string(serviceMethod)
+	endIndex = startIndex + header.ServiceMethodSize
+	body.ServiceMethod = string(data[startIndex:endIndex])
 
 	startIndex = endIndex
-	endIndex = startIndex + payloadSize
-	length = endIndex - startIndex
-	payload := make([]byte, length)
-	copy(payload, data[startIndex:endIndex])
-	body.Payload = payload
+	endIndex = startIndex + header.ErrorSize
+	body.Error = string(data[startIndex:endIndex])
+
+	startIndex = endIndex
+	endIndex = startIndex + header.PayLoadSize
+	body.Payload = data[startIndex:endIndex]
 	return body, nil
 }
 
 // EncodeMessage 发送前编码消息
 func EncodeMessage(message *Message) ([]byte, error) {
+	size := HeaderSize + extensionsSize(message.Header.Extensions) + message.BodySize() + ChecksumSize
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	err := writeMessage(buf, make([]byte, HeaderSize), message)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// BodySize 编码后消息体的大小
+func (m *Message) BodySize() int {
+	body := m.Body
+	return metadataSize(body.Metadata) + len(body.ServiceName) +
+		len(body.ServiceMethod) + len(body.Error) + len(body.Payload)
+}
+
+// MetadataSize 编码后元数据的大小
+func (m *Message) MetadataSize() int {
+	return metadataSize(m.Body.Metadata)
+}
+
+type messageWriter interface {
+	io.Writer
+	io.StringWriter
+}
+
+// writeMessage 将消息依次写入w，headerData用于构建头部
+func writeMessage(w messageWriter, headerData []byte, message *Message) error {
 	header := message.Header
 	body := message.Body
-	serviceNameByte := []byte(body.ServiceName)
-	serviceMethodByte := []byte(body.ServiceMethod)
 
-	msgSize := HeaderSize + len(body.Magic) + len(serviceNameByte) + len(serviceMethodByte) + len(body.Payload)
-	data := make([]byte, msgSize)
+	// 需要校验和时边写边计算
+	var cw *checksumWriter
+	if header.Flags&FlagChecksum != 0 {
+		cw = &checksumWriter{w: w}
+		w = cw
+	}
 
 	// 构建头部
-	data[0] = header.Start
-	data[1] = header.Version
-	data[2] = header.CodecType
-	data[3] = header.CompressorType
-	binary.BigEndian.PutUint32(data[4:8], uint32(len(body.Magic)))
-	binary.BigEndian.PutUint32(data[8:12], uint32(len(serviceNameByte)))
-	binary.BigEndian.PutUint32(data[12:16], uint32(len(serviceMethodByte)))
-	binary.BigEndian.PutUint32(data[16:20], uint32(len(body.Payload)))
+	headerData[0] = header.Start
+	headerData[1] = header.Version
+	headerData[2] = header.MessageType
+	headerData[3] = header.Flags &^ FlagExtension
+	if len(header.Extensions) > 0 {
+		headerData[3] |= FlagExtension
+	}
+	headerData[4] = header.CodecType
+	headerData[5] = header.CompressorType
+	binary.BigEndian.PutUint64(headerData[6:14], header.Seq)
+	binary.BigEndian.PutUint32(headerData[14:18], header.MethodID)
+	binary.BigEndian.PutUint32(headerData[18:22], uint32(metadataSize(body.Metadata)))
+	binary.BigEndian.PutUint32(headerData[22:26], uint32(len(body.ServiceName)))
+	binary.BigEndian.PutUint32(headerData[26:30], uint32(len(body.ServiceMethod)))
+	binary.BigEndian.PutUint32(headerData[30:34], uint32(len(body.Error)))
+	binary.BigEndian.PutUint32(headerData[34:38], uint32(len(body.Payload)))
+	if _, err := w.Write(headerData); err != nil {
+		return err
+	}
+	if err := writeExtensions(w, header.Extensions); err != nil {
+		return err
+	}
 
 	// 构建body
-	startIndex := HeaderSize
-	endIndex := startIndex + len(body.Magic)
-	copy(data[startIndex:endIndex], body.Magic)
+	if err := writeMetadata(w, body.Metadata); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(body.ServiceName); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(body.ServiceMethod); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(body.Error); err != nil {
+		return err
+	}
+	if _, err := w.Write(body.Payload); err != nil {
+		return err
+	}
+	if cw != nil {
+		return cw.writeSum()
+	}
+	return nil
+}
 
-	startIndex = endIndex
-	endIndex = startIndex + len(body.ServiceName)
-	copy(data[startIndex:endIndex], body.ServiceName)
+// metadataSize 编码后元数据的大小
+func metadataSize(md map[string]string) int {
+	size := 0
+	for k, v := range md {
+		size += 8 + len(k) + len(v)
+	}
+	return size
+}
 
-	startIndex = endIndex
-	endIndex = startIndex + len(body.ServiceMethod)
-	copy(data[startIndex:endIndex], body.ServiceMethod)
+// writeMetadata 编码元数据并写入w，按key排序保证相同的元数据编码结果一致
+func writeMetadata(w messageWriter, md map[string]string) error {
+	if len(md) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	startIndex = endIndex
-	endIndex = startIndex + len(body.Payload)
-	copy(data[startIndex:endIndex], body.Payload)
+	var sizeData [4]byte
+	for _, k := range keys {
+		for _, field := range [2]string{k, md[k]} {
+			binary.BigEndian.PutUint32(sizeData[:], uint32(len(field)))
+			if _, err := w.Write(sizeData[:]); err != nil {
+				return err
+			}
+			if _, err := w.WriteString(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeMetadata 解码元数据
+func decodeMetadata(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	md := make(map[string]string)
+	var index uint32 = 0
+	size := uint32(len(data))
+	for index < size {
+		key, next, err := readMetadataField(data, index)
+		if err != nil {
+			return nil, err
+		}
+		value, next, err := readMetadataField(data, next)
+		if err != nil {
+			return nil, err
+		}
+		md[key] = value
+		index = next
+	}
+	return md, nil
+}
 
-	return data, nil
+// readMetadataField 从index处读取一个长度前缀的字段，返回字段值和下一个字段的位置
+func readMetadataField(data []byte, index uint32) (string, uint32, error) {
+	size := uint32(len(data))
+	if size-index < 4 {
+		return "", 0, errors.New("the metadata is not valid")
+	}
+	fieldSize := binary.BigEndian.Uint32(data[index : index+4])
+	index += 4
+	if size-index < fieldSize {
+		return "", 0, errors.New("the metadata is not valid")
+	}
+	return string(data[index : index+fieldSize]), index + fieldSize, nil
 }
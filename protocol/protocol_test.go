@@ -0,0 +1,377 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/15 16:30
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func newTestMessage() *Message {
+	return &Message{
+		Header: &Header{
+			Start:   StartChar,
+			Version: byte(1),
+			Seq:     1,
+		},
+		Body: &Body{
+			Metadata:      map[string]string{"trace-id": "123", "tenant": "sparrow"},
+			ServiceName:   "HelloWorld",
+			ServiceMethod: "Hello",
+			Payload:       []byte(`{"Name":"cyj19"}`),
+		},
+	}
+}
+
+func TestEncodeDecodeMessage(t *testing.T) {
+	msg := newTestMessage()
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := DecodeMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Body, result.Body) {
+		t.Fatalf("expect %+v, got %+v", msg.Body, result.Body)
+	}
+	if result.Header.Seq != msg.Header.Seq {
+		t.Fatalf("expect seq %d, got %d", msg.Header.Seq, result.Header.Seq)
+	}
+}
+
+func TestDecodeMessageInvalidMetadata(t *testing.T) {
+	msg := newTestMessage()
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 篡改第一个key的长度
+	data[HeaderSize] = 0xff
+	if _, err = DecodeMessage(bytes.NewReader(data)); err == nil {
+		t.Fatal("expect error for invalid metadata")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := &HandshakeInfo{Version: 2, Codecs: []byte{3, 0, 1}, Compressors: []byte{0}, MaxFrameSize: 1024, MaxErrorSize: 256}
+	remote := &HandshakeInfo{Version: 1, Codecs: []byte{0, 1}, Compressors: []byte{1}, MaxErrorSize: 128}
+	info := Negotiate(local, remote)
+	if info.Version != 1 {
+		t.Fatalf("expect version 1, got %d", info.Version)
+	}
+	if !reflect.DeepEqual(info.Codecs, []byte{0, 1}) {
+		t.Fatalf("expect codecs [0 1], got %v", info.Codecs)
+	}
+	if len(info.Compressors) != 0 {
+		t.Fatalf("expect no compressors, got %v", info.Compressors)
+	}
+	if info.MaxFrameSize != 1024 {
+		t.Fatalf("expect max frame size 1024, got %d", info.MaxFrameSize)
+	}
+	if info.MaxErrorSize != 128 || info.MaxMetadataSize != 0 {
+		t.Fatalf("expect max error size 128 and unlimited metadata, got %d %d", info.MaxErrorSize, info.MaxMetadataSize)
+	}
+}
+
+func TestDecodeMessageWithLimit(t *testing.T) {
+	msg := newTestMessage()
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 消息头声明超大的payload，解码时不能分配内存
+	data[HeaderSize-4] = 0xff
+	_, err = DecodeMessage(bytes.NewReader(data))
+	var sizeErr *FrameSizeError
+	if !errors.As(err, &sizeErr) || sizeErr.Field != "payload" {
+		t.Fatalf("expect payload FrameSizeError, got %v", err)
+	}
+
+	_, err = DecodeMessageWithLimit(bytes.NewReader(data[:HeaderSize+10]), &Limit{MaxBodySize: 8})
+	if !errors.As(err, &sizeErr) || sizeErr.Field != "body" {
+		t.Fatalf("expect body FrameSizeError, got %v", err)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	msg := newTestMessage()
+	for i := 0; i < 3; i++ {
+		if err := encoder.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(&buf, DefaultLimit)
+	for i := 0; i < 3; i++ {
+		result, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg.Body, result.Body) {
+			t.Fatalf("expect %+v, got %+v", msg.Body, result.Body)
+		}
+		result.Release()
+	}
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	msg := newTestMessage()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := EncodeMessage(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = io.Discard.Write(data)
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	msg := newTestMessage()
+	encoder := NewEncoder(io.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := encoder.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// repeatReader 循环读取同一个消息，模拟连接上连续到达的消息
+type repeatReader struct {
+	data  []byte
+	index int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.index:])
+		n += c
+		r.index = (r.index + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	data, err := EncodeMessage(newTestMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := &repeatReader{data: data}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err = DecodeMessage(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	data, err := EncodeMessage(newTestMessage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	decoder := NewDecoder(&repeatReader{data: data}, DefaultLimit)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg, err := decoder.Decode()
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.Release()
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	msg := newTestMessage()
+	msg.Header.Flags |= FlagChecksum
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != HeaderSize+msg.BodySize()+ChecksumSize {
+		t.Fatalf("expect checksum trailer, got %d bytes", len(data))
+	}
+	result, err := DecodeMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg.Body, result.Body) {
+		t.Fatalf("expect %+v, got %+v", msg.Body, result.Body)
+	}
+
+	// 篡改payload的一个字节
+	data[len(data)-ChecksumSize-1] ^= 0xff
+	if _, err = DecodeMessage(bytes.NewReader(data)); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expect ErrChecksum, got %v", err)
+	}
+}
+
+func TestExtension(t *testing.T) {
+	msg := newTestMessage()
+	msg.Header.Flags |= FlagChecksum
+	msg.Header.SetExtension(1, []byte("known"))
+	// 解码器不认识的类型也能跳过，不影响消息体的解析
+	msg.Header.SetExtension(200, []byte{})
+	data, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := DecodeMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Header.Flags&FlagExtension == 0 {
+		t.Fatal("expect FlagExtension")
+	}
+	if value, ok := result.Header.Extension(1); !ok || string(value) != "known" {
+		t.Fatalf("expect extension known, got %q", value)
+	}
+	if _, ok := result.Header.Extension(200); !ok {
+		t.Fatal("expect extension 200")
+	}
+	if !reflect.DeepEqual(msg.Body, result.Body) {
+		t.Fatalf("expect %+v, got %+v", msg.Body, result.Body)
+	}
+
+	limit := *DefaultLimit
+	limit.MaxExtensionSize = 4
+	_, err = DecodeMessageWithLimit(bytes.NewReader(data), &limit)
+	var sizeErr *FrameSizeError
+	if !errors.As(err, &sizeErr) || sizeErr.Field != "extension" {
+		t.Fatalf("expect extension FrameSizeError, got %v", err)
+	}
+}
+
+func TestFragmentAssembler(t *testing.T) {
+	first := newTestMessage()
+	first.Body.Payload = bytes.Repeat([]byte("a"), 100)
+	second := newTestMessage()
+	second.Header.Seq = 2
+	second.Body.Payload = bytes.Repeat([]byte("b"), 50)
+
+	// 两个消息的分片交错写入
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	firstFragments := Fragment(first, 30)
+	secondFragments := Fragment(second, 30)
+	if len(firstFragments) != 4 || len(secondFragments) != 2 {
+		t.Fatalf("expect 4 and 2 fragments, got %d and %d", len(firstFragments), len(secondFragments))
+	}
+	for i := 0; i < len(firstFragments); i++ {
+		if err := encoder.Write(firstFragments[i]); err != nil {
+			t.Fatal(err)
+		}
+		if i < len(secondFragments) {
+			if err := encoder.Write(secondFragments[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := NewDecoder(&buf, DefaultLimit)
+	assembler := NewAssembler(nil)
+	var results []*Message
+	for len(results) < 2 {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err = assembler.Add(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil {
+			results = append(results, msg)
+		}
+	}
+	// 第二个消息的分片较少，先重组完成
+	if !reflect.DeepEqual(results[0].Body, second.Body) || !reflect.DeepEqual(results[1].Body, first.Body) {
+		t.Fatalf("unexpected assembled messages: %+v %+v", results[0].Body, results[1].Body)
+	}
+	if assembler.Pending() != 0 {
+		t.Fatalf("expect no pending message, got %d", assembler.Pending())
+	}
+}
+
+func TestAssemblerMaxSize(t *testing.T) {
+	msg := newTestMessage()
+	msg.Body.Payload = bytes.Repeat([]byte("a"), 100)
+	assembler := NewAssembler(&Limit{MaxMessageSize: 50})
+	var sizeErr *FrameSizeError
+	errCount := 0
+	for _, fragment := range Fragment(msg, 30) {
+		result, err := assembler.Add(fragment)
+		if errors.As(err, &sizeErr) {
+			errCount++
+		}
+		if result != nil {
+			t.Fatal("expect the message to be dropped")
+		}
+	}
+	if errCount != 1 || assembler.Pending() != 0 {
+		t.Fatalf("expect one FrameSizeError and no pending message, got %d and %d", errCount, assembler.Pending())
+	}
+}
+
+func TestAssemblerRemove(t *testing.T) {
+	msg := newTestMessage()
+	msg.Body.Payload = bytes.Repeat([]byte("a"), 100)
+	fragments := Fragment(msg, 30)
+	assembler := NewAssembler(nil)
+	if result, err := assembler.Add(fragments[0]); result != nil || err != nil {
+		t.Fatalf("expect the first fragment to be pending, got %v %v", result, err)
+	}
+	// 取消后剩余的分片不能被当作新的消息重组
+	assembler.Remove(msg.Header.Seq)
+	for _, fragment := range fragments[1:] {
+		result, err := assembler.Add(fragment)
+		if result != nil || err != nil {
+			t.Fatalf("expect the fragment to be dropped, got %v %v", result, err)
+		}
+	}
+	if assembler.Pending() != 0 {
+		t.Fatalf("expect no pending message, got %d", assembler.Pending())
+	}
+}
+
+func TestAssemblerMaxPending(t *testing.T) {
+	first := newTestMessage()
+	first.Body.Payload = bytes.Repeat([]byte("a"), 100)
+	second := newTestMessage()
+	second.Header.Seq = first.Header.Seq + 1
+	second.Body.Payload = bytes.Repeat([]byte("b"), 100)
+	assembler := NewAssembler(&Limit{MaxPendingSize: 2*HeaderSize + 100})
+	firstFragments := Fragment(first, 60)
+	secondFragments := Fragment(second, 60)
+	if _, err := assembler.Add(firstFragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assembler.Add(secondFragments[0]); !errors.Is(err, ErrPendingSize) {
+		t.Fatalf("expect ErrPendingSize, got %v", err)
+	}
+	// 完成重组后释放占用的大小
+	if result, err := assembler.Add(firstFragments[1]); err != nil || result == nil {
+		t.Fatalf("expect the assembled message, got %v %v", result, err)
+	}
+	if _, err := assembler.Add(secondFragments[0]); err != nil {
+		t.Fatal(err)
+	}
+}
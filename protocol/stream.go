@@ -0,0 +1,123 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/17 14:05
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Encoder 将消息直接写入io.Writer，不需要为每个消息分配完整的字节切片
+// 同一个Encoder不能并发使用
+type Encoder struct {
+	w          *bufio.Writer
+	headerData []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+	return &Encoder{
+		w:          bw,
+		headerData: make([]byte, HeaderSize),
+	}
+}
+
+// Write 将消息写入缓冲区，需要调用Flush才会真正发送，适合连续发送多个消息
+func (e *Encoder) Write(message *Message) error {
+	return writeMessage(e.w, e.headerData, message)
+}
+
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+// Encode 写入消息并立即发送
+func (e *Encoder) Encode(message *Message) error {
+	err := e.Write(message)
+	if err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Decoder 从io.Reader中连续解码消息，消息体缓冲区从缓冲池获取
+// 同一个Decoder不能并发使用
+type Decoder struct {
+	r          *bufio.Reader
+	limit      *Limit
+	headerData []byte
+}
+
+// NewDecoder 创建解码器，limit为nil表示不限制
+func NewDecoder(r io.Reader, limit *Limit) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{
+		r:          br,
+		limit:      limit,
+		headerData: make([]byte, HeaderSize),
+	}
+}
+
+// Decode 解码下一个消息，Body.Payload与缓冲池的缓冲区共享内存，使用完需要调用Message.Release归还
+func (d *Decoder) Decode() (*Message, error) {
+	return decodeMessage(d.r, d.headerData, d.limit, true)
+}
+
+// Release 将消息体缓冲区归还缓冲池，之后不能再使用解码时得到的Body.Payload
+func (m *Message) Release() {
+	if m.buf == nil {
+		return
+	}
+	if m.Body != nil && m.Owns(m.Body.Payload) {
+		m.Body.Payload = nil
+	}
+	putBuffer(m.buf)
+	m.buf = nil
+}
+
+// Owns 判断data是否引用了消息体缓冲区，如解压插件直接返回了原始数据，此时需要拷贝后才能Release
+func (m *Message) Owns(data []byte) bool {
+	if m.buf == nil || cap(data) == 0 || cap(*m.buf) == 0 {
+		return false
+	}
+	// payload位于消息体的末尾，引用缓冲区时两者容量的最后一个元素是同一个
+	buf := *m.buf
+	return &data[:cap(data)][cap(data)-1] == &buf[:cap(buf)][cap(buf)-1]
+}
+
+// maxPooledBufferSize 超过该大小的缓冲区不放回缓冲池，避免长期占用大块内存
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// getBuffer 从缓冲池获取长度为size的缓冲区
+func getBuffer(size int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
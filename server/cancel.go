@@ -0,0 +1,59 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/19 16:20
+ */
+
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// activeCalls 连接上正在处理的调用，用于响应客户端的取消
+type activeCalls struct {
+	mu      *sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+func newActiveCalls() *activeCalls {
+	return &activeCalls{
+		mu:      new(sync.Mutex),
+		cancels: map[uint64]context.CancelFunc{},
+	}
+}
+
+func (a *activeCalls) add(seq uint64, cancel context.CancelFunc) {
+	a.mu.Lock()
+	a.cancels[seq] = cancel
+	a.mu.Unlock()
+}
+
+func (a *activeCalls) remove(seq uint64) {
+	a.mu.Lock()
+	delete(a.cancels, seq)
+	a.mu.Unlock()
+}
+
+// cancel 取消序列号对应的调用，调用已经结束时返回false
+func (a *activeCalls) cancel(seq uint64) bool {
+	a.mu.Lock()
+	cancel, ok := a.cancels[seq]
+	delete(a.cancels, seq)
+	a.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// cancelAll 连接关闭时取消所有调用
+func (a *activeCalls) cancelAll() {
+	a.mu.Lock()
+	cancels := a.cancels
+	a.cancels = map[uint64]context.CancelFunc{}
+	a.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,52 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/16 10:40
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/cyj19/sparrow/codec"
+	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/protocol"
+)
+
+// handshakeInfo 服务端支持的能力
+func (s *Server) handshakeInfo() *protocol.HandshakeInfo {
+	info := &protocol.HandshakeInfo{
+		Version:      protocol.Version,
+		FragmentSize: uint32(s.Option.FragmentSize),
+	}
+	if s.Option.Limit != nil {
+		info.MaxFrameSize = s.Option.Limit.MaxBodySize
+		info.MaxMetadataSize = s.Option.Limit.MaxMetadataSize
+		info.MaxErrorSize = s.Option.Limit.MaxErrorSize
+	}
+	for _, cType := range codec.Types() {
+		info.Codecs = append(info.Codecs, byte(cType))
+	}
+	for _, cType := range compressor.Types() {
+		info.Compressors = append(info.Compressors, byte(cType))
+	}
+	return info
+}
+
+// handleHandshake 与客户端协商协议版本和插件，回复并返回协商结果，失败时返回nil
+func (s *Server) handleHandshake(sChannel *SendChannel, reqMsg *protocol.Message) *protocol.HandshakeInfo {
+	defer reqMsg.Release()
+	remote, err := protocol.DecodeHandshake(reqMsg.Body.Payload)
+	if err != nil {
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: decode handshake error:%v", err))
+		return nil
+	}
+	// 以客户端的优先级为准
+	info := protocol.Negotiate(remote, s.handshakeInfo())
+	payload, err := protocol.EncodeHandshake(info)
+	if err != nil {
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: encode handshake error:%v", err))
+		return nil
+	}
+	s.send(sChannel, protocol.Handshake, reqMsg, nil, payload, "")
+	return info
+}
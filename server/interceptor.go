@@ -0,0 +1,41 @@
+/**
+ * @Author: cyj19
+ * @Date: 2022/3/29 15:20
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/cyj19/sparrow/metadata"
+	"net"
+)
+
+// RequestInfo 拦截器可以获取的请求信息
+type RequestInfo struct {
+	ServiceName   string
+	ServiceMethod string
+	RemoteAddr    net.Addr
+	Metadata      metadata.MD
+	Args          interface{} // 反序列化后的参数，拦截器替换传给handler的参数不会改变它
+}
+
+// Handler 调用服务方法
+type Handler func(ctx context.Context, args, reply interface{}) error
+
+// Interceptor 服务端拦截器，在调用服务方法前后执行自定义逻辑，调用handler继续执行后面的拦截器和方法
+// args为反序列化后的参数，传给handler的args和reply就是后面的拦截器和方法收到的参数
+// 替换的args和reply必须与方法的参数类型一致，回复给客户端的是方法收到的reply
+// 不调用handler直接返回错误时，错误作为调用结果回复给客户端
+type Interceptor func(ctx context.Context, info *RequestInfo, args, reply interface{}, handler Handler) error
+
+// chainInterceptors 将拦截器和handler组合为一个Handler，第一个拦截器在最外层
+func chainInterceptors(interceptors []Interceptor, info *RequestInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, args, reply interface{}) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return handler
+}
@@ -7,6 +7,7 @@ package server
 
 import (
 	"context"
+	"github.com/cyj19/sparrow/protocol"
 	"github.com/cyj19/sparrow/transport"
 	"net"
 )
@@ -18,6 +19,10 @@ type Option struct {
 	Host            string             // 服务端地址
 	nl              net.Listener
 	SendChannelSize int
+	Limit           *protocol.Limit // 解码请求时的大小限制，nil表示不限制
+	Checksum        bool            // 响应是否携带CRC32校验和，请求携带时响应总是携带
+	FragmentSize    int             // 分片大小，与客户端协商后payload超过该大小的响应拆分发送，0表示不分片
+	Interceptors    []Interceptor   // 服务端拦截器，按添加顺序从外到内执行
 }
 
 func genDefaultOption() *Option {
@@ -26,6 +31,8 @@ func genDefaultOption() *Option {
 		Protocol:        transport.TCP,
 		Host:            "0.0.0.0:8787",
 		SendChannelSize: 1000,
+		Limit:           protocol.DefaultLimit,
+		FragmentSize:    1 << 20,
 	}
 }
 
@@ -52,3 +59,31 @@ func UseHTTP(host string) OptionSetter {
 		option.Protocol = "http"
 	}
 }
+
+// UseLimit 设置解码请求时的大小限制
+func UseLimit(limit *protocol.Limit) OptionSetter {
+	return func(option *Option) {
+		option.Limit = limit
+	}
+}
+
+// UseChecksum 响应携带CRC32校验和
+func UseChecksum() OptionSetter {
+	return func(option *Option) {
+		option.Checksum = true
+	}
+}
+
+// UseFragmentSize 设置分片大小，0表示不分片
+func UseFragmentSize(size int) OptionSetter {
+	return func(option *Option) {
+		option.FragmentSize = size
+	}
+}
+
+// UseInterceptor 添加服务端拦截器，先添加的拦截器在外层
+func UseInterceptor(interceptors ...Interceptor) OptionSetter {
+	return func(option *Option) {
+		option.Interceptors = append(option.Interceptors, interceptors...)
+	}
+}
@@ -6,13 +6,18 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/cyj19/sparrow/codec"
 	"github.com/cyj19/sparrow/compressor"
+	"github.com/cyj19/sparrow/metadata"
 	"github.com/cyj19/sparrow/protocol"
 	"io"
 	"log"
 	"net"
 	"reflect"
+	"time"
 )
 
 // 处理请求
@@ -20,12 +25,17 @@ func (s *Server) process(conn net.Conn) {
 	defer conn.Close()
 
 	sChannel := NewSendChannel(s.Option.SendChannelSize)
+	writeDone := make(chan struct{})
 	defer func() {
 		sChannel.Close()
+		// 等待剩余的消息写完再关闭连接
+		<-writeDone
 	}()
 
 	// 回复消息
 	go func() {
+		defer close(writeDone)
+		encoder := protocol.NewEncoder(conn)
 	loop:
 		for {
 			select {
@@ -34,8 +44,11 @@ func (s *Server) process(conn net.Conn) {
 					break loop
 
 				}
-				// 写入响应
-				_, err := conn.Write(respMsg)
+				// 写入响应，通道中没有待发送的消息时才发送，合并连续的小消息
+				err := encoder.Write(respMsg)
+				if err == nil && len(sChannel.Ch) == 0 {
+					err = encoder.Flush()
+				}
 				if err != nil {
 					log.Printf("conn.Write error:%v", err)
 					break loop
@@ -45,106 +58,309 @@ func (s *Server) process(conn net.Conn) {
 		}
 	}()
 
+	// 连接关闭时取消还在处理的调用
+	calls := newActiveCalls()
+	defer calls.cancelAll()
+
 	// 读取消息
+	decoder := protocol.NewDecoder(conn, s.Option.Limit)
+	assembler := protocol.NewAssembler(s.Option.Limit)
 	for {
-		message, err := protocol.DecodeMessage(conn)
+		message, err := decoder.Decode()
 		if err != nil {
 			// 说明连接被对端关闭了
 			if err == io.EOF {
 				log.Printf("ip: %s close", conn.RemoteAddr())
 				break
 			}
+			// 消息超过大小限制或校验和不一致，无法继续解析后续消息，回复错误后关闭连接
+			var sizeErr *protocol.FrameSizeError
+			if errors.As(err, &sizeErr) {
+				s.sendError(sChannel, &protocol.Message{Header: sizeErr.Header, Body: &protocol.Body{}}, fmt.Errorf("rpc server: %v", err))
+			}
+			if errors.Is(err, protocol.ErrChecksum) {
+				header := &protocol.Header{Start: protocol.StartChar, Version: protocol.Version}
+				s.sendError(sChannel, &protocol.Message{Header: header, Body: &protocol.Body{}}, fmt.Errorf("rpc server: %v", err))
+			}
 			//log.Printf("protocol.DecodeMessage error:%v", err)
 			break
 		}
 
-		go s.handleRequest(sChannel, message)
+		msgType := protocol.MessageType(message.Header.MessageType)
+		// 取消消息与被取消的请求序列号相同，在重组分片前处理
+		if msgType == protocol.Cancel {
+			assembler.Remove(message.Header.Seq)
+			if calls.cancel(message.Header.Seq) {
+				log.Printf("rpc server: the call of seq:%d is canceled by client", message.Header.Seq)
+			}
+			message.Release()
+			continue
+		}
+		// 重组分片，分片没有接收完时继续读取
+		message, err = assembler.Add(message)
+		if err != nil {
+			var sizeErr *protocol.FrameSizeError
+			if errors.As(err, &sizeErr) {
+				go s.sendError(sChannel, &protocol.Message{Header: sizeErr.Header, Body: &protocol.Body{}}, fmt.Errorf("rpc server: %v", err))
+			}
+			// 未完成的分片占用过多内存，回复错误后关闭连接
+			if errors.Is(err, protocol.ErrPendingSize) {
+				header := &protocol.Header{Start: protocol.StartChar, Version: protocol.Version}
+				s.sendError(sChannel, &protocol.Message{Header: header, Body: &protocol.Body{}}, fmt.Errorf("rpc server: %v", err))
+				break
+			}
+			continue
+		}
+		if message == nil {
+			continue
+		}
+		// 握手之外的消息必须使用服务端支持的协议版本
+		if msgType != protocol.Handshake && message.Header.Version > protocol.Version {
+			go s.sendError(sChannel, message, fmt.Errorf("rpc server: not support protocol version:%d", message.Header.Version))
+			continue
+		}
+		// 根据消息类型分发
+		switch msgType {
+		case protocol.Handshake:
+			// 握手在读取消息的协程中完成，之后的响应使用协商的分片大小
+			if info := s.handleHandshake(sChannel, message); info != nil {
+				sChannel.SetFragmentSize(int(info.FragmentSize))
+				sChannel.SetLimit(&protocol.Limit{
+					MaxBodySize:     info.MaxFrameSize,
+					MaxMetadataSize: info.MaxMetadataSize,
+					MaxErrorSize:    info.MaxErrorSize,
+				})
+			}
+		case protocol.Request, protocol.Oneway:
+			// 在读取消息的协程中登记调用，保证随后到达的取消消息能找到它
+			ctx, cancel := s.requestContext(message)
+			calls.add(message.Header.Seq, cancel)
+			go func() {
+				defer func() {
+					calls.remove(message.Header.Seq)
+					cancel()
+				}()
+				s.handleRequest(ctx, sChannel, conn.RemoteAddr(), message)
+			}()
+		case protocol.Heartbeat:
+			go s.handleHeartbeat(sChannel, message)
+		default:
+			go s.sendError(sChannel, message, fmt.Errorf("rpc server: not support message type:%d", message.Header.MessageType))
+		}
 	}
 
 }
 
-func (s *Server) handleRequest(sChannel *SendChannel, reqMsg *protocol.Message) {
+// handleRequest 处理请求，reqCtx携带客户端的截止时间，客户端取消调用时reqCtx被取消
+func (s *Server) handleRequest(reqCtx context.Context, sChannel *SendChannel, remoteAddr net.Addr, reqMsg *protocol.Message) {
+	defer reqMsg.Release()
+	// 方法或拦截器panic时回复错误，不影响其他调用
+	defer func() {
+		if r := recover(); r != nil {
+			s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: handle request panic: %v", r))
+		}
+	}()
 
 	compressorType := compressor.CompressorType(reqMsg.Header.CompressorType)
 	compressPlugin, ex := compressor.Get(compressorType)
 	if !ex {
-		log.Println("rpc not have this compressor type")
+		s.sendError(sChannel, reqMsg, errors.New("rpc server: not have this compressor type"))
 		return
 	}
 
 	cType := codec.CodecType(reqMsg.Header.CodecType)
 	codecPlugin, ok := codec.Get(cType)
 	if !ok {
-		log.Println("rpc not have this codecType")
+		s.sendError(sChannel, reqMsg, errors.New("rpc server: not have this codec type"))
 		return
 	}
-	serviceName := reqMsg.Body.ServiceName
-	serviceMethod := reqMsg.Body.ServiceMethod
-
 	// 获取服务实例
-	srv, ok := s.serviceMap[serviceName]
-	if !ok {
-		log.Printf("the service:%s is not register", serviceName)
-		return
-	}
-	method, ok := srv.methodMap[serviceMethod]
-	if !ok {
-		log.Printf("the method:%s is not register", serviceMethod)
+	srv, method, err := s.findMethod(reqMsg)
+	if err != nil {
+		reqMsg.Header.MethodID = 0
+		s.sendError(sChannel, reqMsg, err)
 		return
 	}
+	serviceName := srv.name
+	serviceMethod := method.method.Name
+	// 响应携带方法编号，客户端之后的请求只发送编号
+	reqMsg.Header.MethodID = method.id
 	// 创建参数实例
 	argVal := reflect.New(method.argType.Elem()).Interface()
 	replyVal := reflect.New(method.replyType.Elem()).Interface()
 
 	// 解压
-	var err error
-	reqMsg.Body.Payload, err = compressPlugin.Unzip(reqMsg.Body.Payload)
+	payload, err := compressPlugin.Unzip(reqMsg.Body.Payload)
 	if err != nil {
-		log.Printf("server compressor.Unzip error:%#v", err)
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: unzip payload error:%v", err))
+		return
 	}
+	// 解压后不再需要原始的消息体，归还缓冲区前确保payload不引用它
+	if reqMsg.Owns(payload) {
+		payload = append([]byte(nil), payload...)
+	}
+	reqMsg.Release()
+	reqMsg.Body.Payload = payload
 
 	// 反序列化
 	err = codecPlugin.Decode(reqMsg.Body.Payload, argVal)
 	if err != nil {
-		log.Printf("server codecPlugin.Decode error:%v", err)
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: decode payload error:%v", err))
 		return
 	}
-	// 调用方法
-	reflectValues := method.method.Func.Call([]reflect.Value{srv.refVal, reflect.ValueOf(argVal), reflect.ValueOf(replyVal)})
-	errorVal := reflectValues[0].Interface()
-	if errorVal != nil {
-		// 调用失败
-		log.Printf("%s.%s error:%v", serviceName, serviceMethod, errorVal)
+	// 请求的元数据放入ctx，方法通过metadata.FromIncomingContext获取，通过metadata.SetTrailer设置响应的元数据
+	md := metadata.New(reqMsg.Body.Metadata)
+	ctx := metadata.NewIncomingContext(reqCtx, md)
+	ctx, trailer := metadata.NewTrailerContext(ctx)
+	// 等待处理期间已经超时或被取消，客户端不再需要结果，不调用方法
+	if errors.Is(ctx.Err(), context.Canceled) {
 		return
 	}
-	// 写消息
-	msg := &protocol.Message{
-		Header: reqMsg.Header,
+	if ctx.Err() != nil {
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: %s.%s %v before invoke", serviceName, serviceMethod, ctx.Err()))
+		return
+	}
+	// 调用方法，配置了拦截器时由拦截器决定是否调用
+	// 拦截器可能替换reply，回复方法实际收到的reply
+	handler := func(ctx context.Context, args, reply interface{}) error {
+		replyVal = reply
+		return srv.call(ctx, method, args, reply)
+	}
+	if len(s.Option.Interceptors) > 0 {
+		info := &RequestInfo{
+			ServiceName:   serviceName,
+			ServiceMethod: serviceMethod,
+			RemoteAddr:    remoteAddr,
+			Metadata:      md,
+			Args:          argVal,
+		}
+		handler = chainInterceptors(s.Option.Interceptors, info, handler)
+	}
+	err = handler(ctx, argVal, replyVal)
+	// 单向调用不需要回复
+	if protocol.MessageType(reqMsg.Header.MessageType) == protocol.Oneway {
+		if err != nil {
+			log.Printf("%s.%s oneway error:%v", serviceName, serviceMethod, err)
+		}
+		return
 	}
-	body := &protocol.Body{
-		Magic:         reqMsg.Body.Magic,
-		ServiceName:   serviceName,
-		ServiceMethod: serviceMethod,
+	// 客户端已经取消调用，丢弃响应
+	if errors.Is(ctx.Err(), context.Canceled) {
+		log.Printf("%s.%s is canceled, drop the response", serviceName, serviceMethod)
+		return
+	}
+	if err != nil {
+		// 调用失败
+		log.Printf("%s.%s error:%v", serviceName, serviceMethod, err)
+		s.sendResponse(sChannel, reqMsg, trailer, nil, err.Error())
+		return
 	}
 	// 序列化
-	body.Payload, err = codecPlugin.Encode(replyVal)
+	payload, err = codecPlugin.Encode(replyVal)
 	if err != nil {
-		log.Printf("codecPlugin.Encode error:%v", err)
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: encode reply error:%v", err))
 		return
 	}
 	// 压缩
-	body.Payload, err = compressPlugin.Zip(body.Payload)
+	payload, err = compressPlugin.Zip(payload)
 	if err != nil {
-		log.Printf("compressPlugin.Encode error:%v", err)
+		s.sendError(sChannel, reqMsg, fmt.Errorf("rpc server: zip reply error:%v", err))
 		return
 	}
-	msg.Body = body
-	msgData, err := protocol.EncodeMessage(msg)
+	s.sendResponse(sChannel, reqMsg, trailer, payload, "")
+}
+
+// requestContext 根据请求元数据中的超时时间创建调用方法的ctx
+func (s *Server) requestContext(reqMsg *protocol.Message) (context.Context, context.CancelFunc) {
+	value, ok := reqMsg.Body.Metadata[metadata.TimeoutKey]
+	if !ok {
+		return context.WithCancel(s.Option.ctx)
+	}
+	timeout, err := time.ParseDuration(value)
 	if err != nil {
-		log.Printf("protocol.EncodeMessage error:%v", err)
+		log.Printf("rpc server: invalid timeout %q: %v", value, err)
+		return context.WithCancel(s.Option.ctx)
+	}
+	return context.WithTimeout(s.Option.ctx, timeout)
+}
+
+// findMethod 查找请求的服务方法，优先使用名称，名称为空时使用方法编号
+func (s *Server) findMethod(reqMsg *protocol.Message) (*service, *methodType, error) {
+	serviceName := reqMsg.Body.ServiceName
+	serviceMethod := reqMsg.Body.ServiceMethod
+	if serviceName == "" && serviceMethod == "" {
+		id := reqMsg.Header.MethodID
+		if id == 0 || int(id) > len(s.methods) {
+			return nil, nil, fmt.Errorf("rpc server: the method id:%d is not register", id)
+		}
+		ref := s.methods[id-1]
+		return ref.srv, ref.method, nil
+	}
+
+	srv, ok := s.serviceMap[serviceName]
+	if !ok {
+		return nil, nil, fmt.Errorf("rpc server: the service:%s is not register", serviceName)
+	}
+	method, ok := srv.methodMap[serviceMethod]
+	if !ok {
+		return nil, nil, fmt.Errorf("rpc server: the method:%s is not register", serviceMethod)
+	}
+	return srv, method, nil
+}
+
+// handleHeartbeat 回复心跳
+func (s *Server) handleHeartbeat(sChannel *SendChannel, reqMsg *protocol.Message) {
+	defer reqMsg.Release()
+	s.send(sChannel, protocol.Heartbeat, reqMsg, nil, nil, "")
+}
+
+// sendError 回复调用失败的消息，保证客户端总能收到响应
+func (s *Server) sendError(sChannel *SendChannel, reqMsg *protocol.Message, err error) {
+	log.Println(err)
+	s.sendResponse(sChannel, reqMsg, nil, nil, err.Error())
+}
+
+// sendResponse 构建响应消息并写入发送通道
+func (s *Server) sendResponse(sChannel *SendChannel, reqMsg *protocol.Message, md metadata.MD, payload []byte, errMsg string) {
+	s.send(sChannel, protocol.Response, reqMsg, md, payload, errMsg)
+}
+
+// send 根据请求构建指定类型的回复消息并写入发送通道
+func (s *Server) send(sChannel *SendChannel, msgType protocol.MessageType, reqMsg *protocol.Message, md metadata.MD, payload []byte, errMsg string) {
+	// 单向调用不回复，包括错误
+	if protocol.MessageType(reqMsg.Header.MessageType) == protocol.Oneway {
 		return
 	}
-	err = sChannel.Send(msgData)
+	header := *reqMsg.Header
+	header.MessageType = byte(msgType)
+	header.Flags = 0
+	// 请求的扩展字段只对请求有意义，不回传给客户端
+	header.Extensions = nil
+	if s.Option.Checksum || reqMsg.Header.Flags&protocol.FlagChecksum != 0 {
+		header.Flags |= protocol.FlagChecksum
+	}
+	msg := &protocol.Message{
+		Header: &header,
+		Body: &protocol.Body{
+			Metadata:      md,
+			ServiceName:   reqMsg.Body.ServiceName,
+			ServiceMethod: reqMsg.Body.ServiceMethod,
+			Error:         errMsg,
+			Payload:       payload,
+		},
+	}
+	err := sChannel.Send(msg)
+	// 响应超过协商的大小限制时客户端会关闭连接，改为回复不携带数据的错误
+	var sizeErr *protocol.FrameSizeError
+	if errors.As(err, &sizeErr) {
+		log.Printf("rpc server: send response error:%v", err)
+		msg.Body = &protocol.Body{
+			ServiceName:   reqMsg.Body.ServiceName,
+			ServiceMethod: reqMsg.Body.ServiceMethod,
+			Error:         fmt.Sprintf("rpc server: send response error:%v", err),
+		}
+		err = sChannel.Send(msg)
+	}
 	if err != nil {
 		log.Println(err)
 		return
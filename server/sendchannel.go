@@ -7,30 +7,84 @@ package server
 
 import (
 	"errors"
+	"github.com/cyj19/sparrow/protocol"
 	"sync"
 )
 
 type SendChannel struct {
-	rw    *sync.RWMutex
-	Ch    chan []byte
-	close bool
+	rw           *sync.RWMutex
+	Ch           chan *protocol.Message
+	close        bool
+	fragmentSize int             // 分片大小，0表示不分片
+	limit        *protocol.Limit // 协商的大小限制，nil表示不限制
 }
 
 func NewSendChannel(size int) *SendChannel {
 	return &SendChannel{
 		rw: new(sync.RWMutex),
-		Ch: make(chan []byte, size),
+		Ch: make(chan *protocol.Message, size),
 	}
 }
 
-func (c *SendChannel) Send(data []byte) error {
+// SetFragmentSize 设置分片大小，payload超过该大小的消息拆分为多个分片发送
+func (c *SendChannel) SetFragmentSize(size int) {
+	c.rw.Lock()
+	c.fragmentSize = size
+	c.rw.Unlock()
+}
+
+// SetLimit 设置协商的消息体、元数据和错误信息的大小限制，超过限制的消息客户端会拒绝并关闭连接
+func (c *SendChannel) SetLimit(limit *protocol.Limit) {
+	c.rw.Lock()
+	c.limit = limit
+	c.rw.Unlock()
+}
+
+// Send 按分片大小拆分后写入发送通道，超过协商的大小限制时不发送，返回*protocol.FrameSizeError
+func (c *SendChannel) Send(msg *protocol.Message) error {
+	c.rw.RLock()
+	size, limit := c.fragmentSize, c.limit
+	c.rw.RUnlock()
+	fragments := protocol.Fragment(msg, size)
+	if err := checkLimit(limit, msg, fragments); err != nil {
+		return err
+	}
+	// 逐个发送分片，期间其他调用的消息可以穿插发送
+	for _, fragment := range fragments {
+		if err := c.send(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLimit 检查消息的元数据、错误信息和每个分片的消息体是否超过限制
+func checkLimit(limit *protocol.Limit, msg *protocol.Message, fragments []*protocol.Message) error {
+	if limit == nil {
+		return nil
+	}
+	if size := uint64(msg.MetadataSize()); limit.MaxMetadataSize > 0 && size > uint64(limit.MaxMetadataSize) {
+		return &protocol.FrameSizeError{Header: msg.Header, Field: "metadata", Size: size, Limit: limit.MaxMetadataSize}
+	}
+	if size := uint64(len(msg.Body.Error)); limit.MaxErrorSize > 0 && size > uint64(limit.MaxErrorSize) {
+		return &protocol.FrameSizeError{Header: msg.Header, Field: "error", Size: size, Limit: limit.MaxErrorSize}
+	}
+	for _, fragment := range fragments {
+		if size := uint64(fragment.BodySize()); limit.MaxBodySize > 0 && size > uint64(limit.MaxBodySize) {
+			return &protocol.FrameSizeError{Header: msg.Header, Field: "body", Size: size, Limit: limit.MaxBodySize}
+		}
+	}
+	return nil
+}
+
+func (c *SendChannel) send(msg *protocol.Message) error {
 	defer c.rw.Unlock()
 	c.rw.Lock()
 
 	if c.close {
 		return errors.New("sendChannel is closed")
 	}
-	c.Ch <- data
+	c.Ch <- msg
 	return nil
 
 }
@@ -10,14 +10,22 @@ import (
 	"fmt"
 	"github.com/cyj19/sparrow/transport"
 	"log"
+	"sort"
 )
 
 // Server 服务管理器
 type Server struct {
 	serviceMap map[string]*service // 服务注册
+	methods    []*methodRef        // 按编号索引的服务方法，编号从1开始
 	Option     *Option             // 管理器配置
 }
 
+// methodRef 编号对应的服务方法
+type methodRef struct {
+	srv    *service
+	method *methodType
+}
+
 func NewServer() *Server {
 	return &Server{
 		serviceMap: map[string]*service{},
@@ -35,6 +43,18 @@ func (s *Server) register(v interface{}, serviceName string, useName bool) error
 	}
 	s.serviceMap[srv.name] = srv
 
+	// 按方法名称顺序分配编号，只追加不修改，已分配的编号保持不变
+	names := make([]string, 0, len(srv.methodMap))
+	for name := range srv.methodMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		method := srv.methodMap[name]
+		s.methods = append(s.methods, &methodRef{srv: srv, method: method})
+		method.id = uint32(len(s.methods))
+	}
+
 	return nil
 }
 
@@ -42,7 +62,7 @@ func (s *Server) Register(v interface{}) error {
 	return s.register(v, "", false)
 }
 
-func (s Server) RegisterName(v interface{}, serviceName string) error {
+func (s *Server) RegisterName(v interface{}, serviceName string) error {
 	return s.register(v, serviceName, true)
 }
 
@@ -58,8 +78,6 @@ func (s *Server) run() error {
 		// 处理请求
 		go s.process(conn)
 	}
-
-	return nil
 }
 
 func (s *Server) Run(fns ...OptionSetter) error {
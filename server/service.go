@@ -6,6 +6,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"go/ast"
@@ -13,12 +14,15 @@ import (
 )
 
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 // 服务的方法
 type methodType struct {
 	method    reflect.Method
 	argType   reflect.Type
 	replyType reflect.Type
+	withCtx   bool   // 方法的第一个参数是否为context.Context
+	id        uint32 // 方法编号，注册到服务端时分配
 	numCall   int
 }
 
@@ -66,13 +70,22 @@ func registerMethods(refType reflect.Type) (map[string]*methodType, error) {
 		if !ast.IsExported(mName) {
 			return nil, errors.New(fmt.Sprintf("method %s is not public", mName))
 		}
-		// 校验函数的输入参数是否符合规则 func(*server.MethodTest, *arg, *reply)
-		if mType.NumIn() != 3 {
+		// 校验函数的输入参数是否符合规则
+		// func(*server.MethodTest, *arg, *reply) 或 func(*server.MethodTest, context.Context, *arg, *reply)
+		if mType.NumIn() != 3 && mType.NumIn() != 4 {
 			continue
 		}
+		withCtx := mType.NumIn() == 4
+		argIndex := 1
+		if withCtx {
+			if mType.In(1) != typeOfContext {
+				continue
+			}
+			argIndex = 2
+		}
 		// 检验输入参数，必须是指针类型
-		argType := mType.In(1)
-		replyType := mType.In(2)
+		argType := mType.In(argIndex)
+		replyType := mType.In(argIndex + 1)
 		if argType.Kind() != reflect.Ptr || replyType.Kind() != reflect.Ptr {
 			continue
 		}
@@ -85,6 +98,7 @@ func registerMethods(refType reflect.Type) (map[string]*methodType, error) {
 			method:    method,
 			argType:   argType,
 			replyType: replyType,
+			withCtx:   withCtx,
 		}
 
 	}
@@ -95,3 +109,25 @@ func registerMethods(refType reflect.Type) (map[string]*methodType, error) {
 
 	return methodMap, nil
 }
+
+// call 调用服务的方法，ctx携带请求的元数据
+// argVal和replyVal可能被拦截器替换，类型与方法的参数不一致时返回错误
+func (s *service) call(ctx context.Context, mType *methodType, argVal, replyVal interface{}) error {
+	if t := reflect.TypeOf(argVal); t != mType.argType {
+		return fmt.Errorf("rpc server: %s.%s args type %v, expect %v", s.name, mType.method.Name, t, mType.argType)
+	}
+	if t := reflect.TypeOf(replyVal); t != mType.replyType {
+		return fmt.Errorf("rpc server: %s.%s reply type %v, expect %v", s.name, mType.method.Name, t, mType.replyType)
+	}
+	in := []reflect.Value{s.refVal}
+	if mType.withCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, reflect.ValueOf(argVal), reflect.ValueOf(replyVal))
+	reflectValues := mType.method.Func.Call(in)
+	errorVal := reflectValues[0].Interface()
+	if errorVal != nil {
+		return errorVal.(error)
+	}
+	return nil
+}